@@ -5,8 +5,13 @@
 package mock
 
 import (
+	aws "github.com/aws/aws-sdk-go/aws"
+	request "github.com/aws/aws-sdk-go/aws/request"
 	cloudwatchlogs "github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	firehose "github.com/aws/aws-sdk-go/service/firehose"
 	s3 "github.com/aws/aws-sdk-go/service/s3"
+	sqs "github.com/aws/aws-sdk-go/service/sqs"
+	ssm "github.com/aws/aws-sdk-go/service/ssm"
 	gomock "github.com/golang/mock/gomock"
 	reflect "reflect"
 )
@@ -47,6 +52,71 @@ func (mr *MockS3MockRecorder) GetObject(arg0 interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetObject", reflect.TypeOf((*MockS3)(nil).GetObject), arg0)
 }
 
+// PutObject mocks base method
+func (m *MockS3) PutObject(arg0 *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	ret := m.ctrl.Call(m, "PutObject", arg0)
+	ret0, _ := ret[0].(*s3.PutObjectOutput)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// PutObject indicates an expected call of PutObject
+func (mr *MockS3MockRecorder) PutObject(arg0 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PutObject", reflect.TypeOf((*MockS3)(nil).PutObject), arg0)
+}
+
+// CreateMultipartUpload mocks base method
+func (m *MockS3) CreateMultipartUpload(arg0 *s3.CreateMultipartUploadInput) (*s3.CreateMultipartUploadOutput, error) {
+	ret := m.ctrl.Call(m, "CreateMultipartUpload", arg0)
+	ret0, _ := ret[0].(*s3.CreateMultipartUploadOutput)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CreateMultipartUpload indicates an expected call of CreateMultipartUpload
+func (mr *MockS3MockRecorder) CreateMultipartUpload(arg0 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateMultipartUpload", reflect.TypeOf((*MockS3)(nil).CreateMultipartUpload), arg0)
+}
+
+// UploadPart mocks base method
+func (m *MockS3) UploadPart(arg0 *s3.UploadPartInput) (*s3.UploadPartOutput, error) {
+	ret := m.ctrl.Call(m, "UploadPart", arg0)
+	ret0, _ := ret[0].(*s3.UploadPartOutput)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// UploadPart indicates an expected call of UploadPart
+func (mr *MockS3MockRecorder) UploadPart(arg0 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UploadPart", reflect.TypeOf((*MockS3)(nil).UploadPart), arg0)
+}
+
+// CompleteMultipartUpload mocks base method
+func (m *MockS3) CompleteMultipartUpload(arg0 *s3.CompleteMultipartUploadInput) (*s3.CompleteMultipartUploadOutput, error) {
+	ret := m.ctrl.Call(m, "CompleteMultipartUpload", arg0)
+	ret0, _ := ret[0].(*s3.CompleteMultipartUploadOutput)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CompleteMultipartUpload indicates an expected call of CompleteMultipartUpload
+func (mr *MockS3MockRecorder) CompleteMultipartUpload(arg0 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CompleteMultipartUpload", reflect.TypeOf((*MockS3)(nil).CompleteMultipartUpload), arg0)
+}
+
+// AbortMultipartUpload mocks base method
+func (m *MockS3) AbortMultipartUpload(arg0 *s3.AbortMultipartUploadInput) (*s3.AbortMultipartUploadOutput, error) {
+	ret := m.ctrl.Call(m, "AbortMultipartUpload", arg0)
+	ret0, _ := ret[0].(*s3.AbortMultipartUploadOutput)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// AbortMultipartUpload indicates an expected call of AbortMultipartUpload
+func (mr *MockS3MockRecorder) AbortMultipartUpload(arg0 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AbortMultipartUpload", reflect.TypeOf((*MockS3)(nil).AbortMultipartUpload), arg0)
+}
+
 // MockCloudWatchLogs is a mock of CloudWatchLogs interface
 type MockCloudWatchLogs struct {
 	ctrl     *gomock.Controller
@@ -95,3 +165,155 @@ func (m *MockCloudWatchLogs) CreateLogStream(arg0 *cloudwatchlogs.CreateLogStrea
 func (mr *MockCloudWatchLogsMockRecorder) CreateLogStream(arg0 interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateLogStream", reflect.TypeOf((*MockCloudWatchLogs)(nil).CreateLogStream), arg0)
 }
+
+// DescribeLogStreams mocks base method
+func (m *MockCloudWatchLogs) DescribeLogStreams(arg0 *cloudwatchlogs.DescribeLogStreamsInput) (*cloudwatchlogs.DescribeLogStreamsOutput, error) {
+	ret := m.ctrl.Call(m, "DescribeLogStreams", arg0)
+	ret0, _ := ret[0].(*cloudwatchlogs.DescribeLogStreamsOutput)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// DescribeLogStreams indicates an expected call of DescribeLogStreams
+func (mr *MockCloudWatchLogsMockRecorder) DescribeLogStreams(arg0 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DescribeLogStreams", reflect.TypeOf((*MockCloudWatchLogs)(nil).DescribeLogStreams), arg0)
+}
+
+// MockFirehose is a mock of Firehose interface
+type MockFirehose struct {
+	ctrl     *gomock.Controller
+	recorder *MockFirehoseMockRecorder
+}
+
+// MockFirehoseMockRecorder is the mock recorder for MockFirehose
+type MockFirehoseMockRecorder struct {
+	mock *MockFirehose
+}
+
+// NewMockFirehose creates a new mock instance
+func NewMockFirehose(ctrl *gomock.Controller) *MockFirehose {
+	mock := &MockFirehose{ctrl: ctrl}
+	mock.recorder = &MockFirehoseMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockFirehose) EXPECT() *MockFirehoseMockRecorder {
+	return m.recorder
+}
+
+// PutRecordBatch mocks base method
+func (m *MockFirehose) PutRecordBatch(arg0 *firehose.PutRecordBatchInput) (*firehose.PutRecordBatchOutput, error) {
+	ret := m.ctrl.Call(m, "PutRecordBatch", arg0)
+	ret0, _ := ret[0].(*firehose.PutRecordBatchOutput)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// PutRecordBatch indicates an expected call of PutRecordBatch
+func (mr *MockFirehoseMockRecorder) PutRecordBatch(arg0 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PutRecordBatch", reflect.TypeOf((*MockFirehose)(nil).PutRecordBatch), arg0)
+}
+
+// MockSSM is a mock of SSM interface
+type MockSSM struct {
+	ctrl     *gomock.Controller
+	recorder *MockSSMMockRecorder
+}
+
+// MockSSMMockRecorder is the mock recorder for MockSSM
+type MockSSMMockRecorder struct {
+	mock *MockSSM
+}
+
+// NewMockSSM creates a new mock instance
+func NewMockSSM(ctrl *gomock.Controller) *MockSSM {
+	mock := &MockSSM{ctrl: ctrl}
+	mock.recorder = &MockSSMMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockSSM) EXPECT() *MockSSMMockRecorder {
+	return m.recorder
+}
+
+// GetParameters mocks base method
+func (m *MockSSM) GetParameters(arg0 *ssm.GetParametersInput) (*ssm.GetParametersOutput, error) {
+	ret := m.ctrl.Call(m, "GetParameters", arg0)
+	ret0, _ := ret[0].(*ssm.GetParametersOutput)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetParameters indicates an expected call of GetParameters
+func (mr *MockSSMMockRecorder) GetParameters(arg0 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetParameters", reflect.TypeOf((*MockSSM)(nil).GetParameters), arg0)
+}
+
+// MockSQS is a mock of SQS interface
+type MockSQS struct {
+	ctrl     *gomock.Controller
+	recorder *MockSQSMockRecorder
+}
+
+// MockSQSMockRecorder is the mock recorder for MockSQS
+type MockSQSMockRecorder struct {
+	mock *MockSQS
+}
+
+// NewMockSQS creates a new mock instance
+func NewMockSQS(ctrl *gomock.Controller) *MockSQS {
+	mock := &MockSQS{ctrl: ctrl}
+	mock.recorder = &MockSQSMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockSQS) EXPECT() *MockSQSMockRecorder {
+	return m.recorder
+}
+
+// ReceiveMessageWithContext mocks base method
+func (m *MockSQS) ReceiveMessageWithContext(arg0 aws.Context, arg1 *sqs.ReceiveMessageInput, arg2 ...request.Option) (*sqs.ReceiveMessageOutput, error) {
+	_s := []interface{}{arg0, arg1}
+	for _, _x := range arg2 {
+		_s = append(_s, _x)
+	}
+	ret := m.ctrl.Call(m, "ReceiveMessageWithContext", _s...)
+	ret0, _ := ret[0].(*sqs.ReceiveMessageOutput)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ReceiveMessageWithContext indicates an expected call of ReceiveMessageWithContext
+func (mr *MockSQSMockRecorder) ReceiveMessageWithContext(arg0, arg1 interface{}, arg2 ...interface{}) *gomock.Call {
+	_s := append([]interface{}{arg0, arg1}, arg2...)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ReceiveMessageWithContext", reflect.TypeOf((*MockSQS)(nil).ReceiveMessageWithContext), _s...)
+}
+
+// DeleteMessage mocks base method
+func (m *MockSQS) DeleteMessage(arg0 *sqs.DeleteMessageInput) (*sqs.DeleteMessageOutput, error) {
+	ret := m.ctrl.Call(m, "DeleteMessage", arg0)
+	ret0, _ := ret[0].(*sqs.DeleteMessageOutput)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// DeleteMessage indicates an expected call of DeleteMessage
+func (mr *MockSQSMockRecorder) DeleteMessage(arg0 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteMessage", reflect.TypeOf((*MockSQS)(nil).DeleteMessage), arg0)
+}
+
+// ChangeMessageVisibility mocks base method
+func (m *MockSQS) ChangeMessageVisibility(arg0 *sqs.ChangeMessageVisibilityInput) (*sqs.ChangeMessageVisibilityOutput, error) {
+	ret := m.ctrl.Call(m, "ChangeMessageVisibility", arg0)
+	ret0, _ := ret[0].(*sqs.ChangeMessageVisibilityOutput)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ChangeMessageVisibility indicates an expected call of ChangeMessageVisibility
+func (mr *MockSQSMockRecorder) ChangeMessageVisibility(arg0 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ChangeMessageVisibility", reflect.TypeOf((*MockSQS)(nil).ChangeMessageVisibility), arg0)
+}
@@ -0,0 +1,168 @@
+package paramedic
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	ackResultDelivered = "delivered"
+	ackResultIgnored   = "ignored"
+)
+
+type signalAck struct {
+	InstanceID  string    `json:"instanceId"`
+	RunID       string    `json:"runId"`
+	SignalID    string    `json:"signalId"` // id of the signal object, or its version or ETag
+	Action      string    `json:"action"`
+	Signal      int       `json:"signal"`
+	DeliveredAt time.Time `json:"deliveredAt"`
+	TargetPIDs  []int     `json:"targetPids"`
+	Result      string    `json:"result"`           // "delivered", "ignored" or an error
+	Reason      string    `json:"reason,omitempty"` // why the signal is ignored
+}
+
+// SignalAcker writes an ack record to S3 each time a signal from the watcher
+// is applied or ignored, so that operators can tell which instances applied it.
+// Records are written in background so that a slow S3 does not delay the
+// signal handling. All methods are no-op on a nil SignalAcker.
+type SignalAcker struct {
+	s3         S3
+	bucket     string
+	prefix     string
+	instanceID string
+	runID      string
+	sequence   int
+	pending    []ackRecord
+	mutex      sync.Mutex
+	started    bool
+
+	updateCh chan struct{}
+	closeCh  chan struct{}
+	doneCh   chan struct{}
+}
+
+type ackRecord struct {
+	key string
+	ack signalAck
+}
+
+func NewSignalAcker(s3 S3, bucket string, prefix string, instanceID string, runID string) *SignalAcker {
+	return &SignalAcker{
+		s3:         s3,
+		bucket:     bucket,
+		prefix:     prefix,
+		instanceID: instanceID,
+		runID:      runID,
+		mutex:      sync.Mutex{},
+
+		updateCh: make(chan struct{}, 1),
+		closeCh:  make(chan struct{}),
+		doneCh:   make(chan struct{}),
+	}
+}
+
+func (a *SignalAcker) Start() {
+	if a == nil {
+		return
+	}
+	a.started = true
+
+	go func() {
+		defer close(a.doneCh)
+		for {
+			select {
+			case <-a.updateCh:
+				a.upload()
+			case <-a.closeCh:
+				a.upload()
+				return
+			}
+		}
+	}()
+}
+
+// Close writes the records not written yet.
+func (a *SignalAcker) Close() {
+	if a == nil || !a.started {
+		return
+	}
+	close(a.closeCh)
+	<-a.doneCh
+}
+
+// Ack records that sig was sent to pids with the result err.
+func (a *SignalAcker) Ack(s *signal, sig int, pids []int, err error) {
+	if a == nil {
+		return
+	}
+
+	ack := a.newAck(s, sig, pids)
+	if err != nil {
+		ack.Result = err.Error()
+	}
+	a.enqueue(ack)
+}
+
+// Ignore records that s is not applied because of reason.
+func (a *SignalAcker) Ignore(s *signal, reason string) {
+	if a == nil {
+		return
+	}
+
+	ack := a.newAck(s, int(s.number), nil)
+	ack.Result = ackResultIgnored
+	ack.Reason = reason
+	a.enqueue(ack)
+}
+
+func (a *SignalAcker) newAck(s *signal, sig int, pids []int) signalAck {
+	ack := signalAck{
+		InstanceID:  a.instanceID,
+		RunID:       a.runID,
+		SignalID:    s.ID,
+		Action:      s.Action,
+		Signal:      sig,
+		DeliveredAt: time.Now(),
+		TargetPIDs:  pids,
+		Result:      ackResultDelivered,
+	}
+	if ack.SignalID == "" {
+		ack.SignalID = s.identity
+	}
+	if ack.TargetPIDs == nil {
+		ack.TargetPIDs = []int{} // no script is running
+	}
+	return ack
+}
+
+func (a *SignalAcker) enqueue(ack signalAck) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.sequence++
+	// <prefix><instance id>/<run id>/<time>-<sequence>.json
+	key := fmt.Sprintf("%s%s/%s/%s-%d.json", a.prefix, a.instanceID, a.runID, ack.DeliveredAt.UTC().Format("20060102T150405Z"), a.sequence)
+	a.pending = append(a.pending, ackRecord{key: key, ack: ack})
+
+	select {
+	case a.updateCh <- struct{}{}:
+	default: // an upload is already pending
+	}
+}
+
+func (a *SignalAcker) upload() {
+	a.mutex.Lock()
+	records := a.pending
+	a.pending = nil
+	a.mutex.Unlock()
+
+	for _, r := range records {
+		log.Printf("[INFO] Writing a signal ack to s3://%s/%s", a.bucket, r.key)
+		if err := putJSONObject(a.s3, a.bucket, r.key, &r.ack); err != nil {
+			log.Printf("[WARN] Failed to write a signal ack: %s", err)
+		}
+	}
+}
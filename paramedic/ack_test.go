@@ -0,0 +1,127 @@
+package paramedic
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/golang/mock/gomock"
+	"github.com/ryotarai/paramedic-agent/mock"
+)
+
+func TestJobRunner_AcksSignals(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	s3m := mock.NewMockS3(mockCtrl)
+
+	s3m.EXPECT().GetObject(gomock.Any()).Return(&s3.GetObjectOutput{
+		Body: &stringReadCloser{strings.NewReader("#!/bin/sh\nexec sleep 10\n")},
+	}, nil)
+	// a slow S3 does not delay the signal
+	release := make(chan struct{})
+	var put *s3.PutObjectInput
+	s3m.EXPECT().PutObject(gomock.Any()).Do(func(input *s3.PutObjectInput) {
+		<-release
+		put = input
+	}).Return(&s3.PutObjectOutput{}, nil)
+
+	sig, err := parseSignalObject([]byte(`{"version": 2, "id": "stop-1", "signal": "TERM"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signalCh := make(chan *signal, 1)
+	signalCh <- sig
+
+	out := &bytes.Buffer{}
+	acker := NewSignalAcker(s3m, "acks", "paramedic/", "i-123", "run-1")
+	acker.Start()
+	r := &jobRunner{
+		clients:    &awsClients{s3: s3m},
+		out:        out,
+		stdout:     out,
+		stderr:     out,
+		signalCh:   signalCh,
+		acker:      acker,
+		inheritEnv: "all",
+	}
+	run, err := r.runScript("b", "script", 0, RetryPolicy{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if run.last.Signal == nil || *run.last.Signal != 15 {
+		t.Errorf("the script should be terminated by SIGTERM: %+v", run.last)
+	}
+	close(release)
+	acker.Close()
+
+	if put == nil {
+		t.Fatal("an ack is not written")
+	}
+	if aws.StringValue(put.Bucket) != "acks" || !strings.HasPrefix(aws.StringValue(put.Key), "paramedic/i-123/run-1/") {
+		t.Errorf("unexpected location of an ack: s3://%s/%s", aws.StringValue(put.Bucket), aws.StringValue(put.Key))
+	}
+	b, _ := ioutil.ReadAll(put.Body)
+	ack := signalAck{}
+	if err := json.Unmarshal(b, &ack); err != nil {
+		t.Fatal(err)
+	}
+	if ack.SignalID != "stop-1" || ack.Signal != 15 || ack.Result != ackResultDelivered || len(ack.TargetPIDs) != 1 {
+		t.Errorf("unexpected ack: %+v", ack)
+	}
+}
+
+func TestJobRunner_AcksIgnoredSignals(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	s3m := mock.NewMockS3(mockCtrl)
+
+	acks := []signalAck{}
+	s3m.EXPECT().PutObject(gomock.Any()).Do(func(input *s3.PutObjectInput) {
+		b, _ := ioutil.ReadAll(input.Body)
+		ack := signalAck{}
+		if err := json.Unmarshal(b, &ack); err != nil {
+			t.Fatal(err)
+		}
+		acks = append(acks, ack)
+	}).Return(&s3.PutObjectOutput{}, nil).Times(2)
+
+	signalCh := make(chan *signal, 2)
+	for _, data := range []string{
+		`{"version": 2, "id": "pause-1", "action": "pause"}`,
+		`{"version": 2, "id": "stop-1", "signal": "TERM"}`,
+	} {
+		sig, err := parseSignalObject([]byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		signalCh <- sig
+	}
+
+	acker := NewSignalAcker(s3m, "acks", "paramedic/", "i-123", "run-1")
+	acker.Start()
+	r := &jobRunner{
+		out:      ioutil.Discard,
+		signalCh: signalCh,
+		acker:    acker,
+	}
+	// while waiting for a retry, a pause is ignored and a TERM cancels it
+	if sig := r.waitOrSignal(time.Minute); sig == nil || sig.ID != "stop-1" {
+		t.Errorf("got %+v but expected stop-1", sig)
+	}
+	acker.Close()
+
+	if len(acks) != 2 {
+		t.Fatalf("got %d acks but expected 2", len(acks))
+	}
+	if acks[0].SignalID != "pause-1" || acks[0].Result != ackResultIgnored || acks[0].Reason == "" {
+		t.Errorf("unexpected ack of the ignored signal: %+v", acks[0])
+	}
+	if acks[1].SignalID != "stop-1" || acks[1].Result != ackResultDelivered || len(acks[1].TargetPIDs) != 0 {
+		t.Errorf("unexpected ack of the terminating signal: %+v", acks[1])
+	}
+}
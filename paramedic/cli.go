@@ -1,12 +1,15 @@
 package paramedic
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
-	"syscall"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -14,7 +17,10 @@ import (
 
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/firehose"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/ssm"
 )
 
 const agentExitCode = 255
@@ -30,16 +36,51 @@ type Options struct {
 	ShowVersion           bool
 	OutputLogGroup        string
 	OutputLogStreamPrefix string
+	OutputFormat          string
 	SignalS3Bucket        string
 	SignalS3Key           string
+	SignalS3KeyPrefix     string
+	SignalSQSQueueURL     string
+	SignalSQSEndpoint     string
+	ControlSocket         string
+	SignalFailureLimit    int
+	SignalFailureAction   string
+	SignalAckS3Bucket     string
+	SignalAckS3KeyPrefix  string
 	ScriptS3Bucket        string
 	ScriptS3Key           string
+	ManifestS3Bucket      string
+	ManifestS3Key         string
+	TranscriptS3Bucket    string
+	TranscriptS3KeyPrefix string
+	TranscriptKMSKeyID    string
+	TranscriptGzip        bool
+	FirehoseStream        string
+	FirehoseEndpoint      string
+	LocalLog              string
+	LocalLogAddress       string
+	ResultS3Bucket        string
+	ResultS3KeyPrefix     string
+	StatusS3Bucket        string
+	StatusS3KeyPrefix     string
+	RunID                 string
 	AWSCredentialProvider string
 	UploadInterval        time.Duration
 	SignalInterval        time.Duration
+	ShutdownGracePeriod   time.Duration
+	Redact                bool
+	Env                   envFlag
+	SecretsFile           bool
+	InheritEnv            string
+	LogRoutes             []LogRoute // from the config file
+	Redaction             Redaction  // from the config file
 }
 
 func (c *CLI) Start() int {
+	if len(os.Args) > 1 && isControlCommand(os.Args[1]) {
+		return c.control(os.Args[1], os.Args[2:])
+	}
+
 	options, err := c.parseFlag(os.Args[0], os.Args[1:])
 	if err != nil {
 		log.Printf("[ERROR] %s", err)
@@ -76,6 +117,8 @@ func loadConfigToOptions(path string, options *Options) {
 	if options.AWSCredentialProvider == "" {
 		options.AWSCredentialProvider = cfg.AWSCredentialProvider
 	}
+	options.LogRoutes = cfg.LogRoutes
+	options.Redaction = cfg.Redaction
 }
 
 func (c *CLI) validateOptions(options *Options) error {
@@ -85,35 +128,90 @@ func (c *CLI) validateOptions(options *Options) error {
 	if options.OutputLogStreamPrefix == "" {
 		return errors.New("-output-log-stream-prefix is mandatory option")
 	}
-	if options.SignalS3Bucket == "" {
-		return errors.New("-signal-s3-bucket is mandatory option")
+	if options.OutputFormat != "text" && options.OutputFormat != "json" {
+		return errors.New("-output-format must be one of 'text' and 'json'")
+	}
+	if options.SignalSQSQueueURL == "" {
+		if options.SignalS3Bucket == "" {
+			return errors.New("-signal-s3-bucket is mandatory option (unless -signal-sqs-queue-url is given)")
+		}
+		if options.SignalS3Key == "" {
+			return errors.New("-signal-s3-key is mandatory option (unless -signal-sqs-queue-url is given)")
+		}
+	}
+	switch options.SignalFailureAction {
+	case signalFailureKeep, signalFailureWarn, signalFailureTerminate:
+	default:
+		return errors.New("-signal-failure-action must be one of 'keep', 'warn' and 'terminate'")
 	}
-	if options.SignalS3Key == "" {
-		return errors.New("-signal-s3-key is mandatory option")
+	if options.SignalAckS3KeyPrefix != "" && options.SignalAckS3Bucket == "" && options.SignalS3Bucket == "" {
+		return errors.New("-signal-ack-s3-bucket is mandatory option with -signal-ack-s3-key-prefix")
 	}
 	if options.ScriptS3Bucket == "" {
 		return errors.New("-script-s3-bucket is mandatory option")
 	}
-	if options.ScriptS3Key == "" {
-		return errors.New("-script-s3-key is mandatory option")
+	if options.ScriptS3Key == "" && options.ManifestS3Key == "" {
+		return errors.New("-script-s3-key is mandatory option (unless the manifest given by -manifest-s3-key has Steps)")
+	}
+	for _, r := range options.LogRoutes {
+		if err := r.validate(); err != nil {
+			return err
+		}
+	}
+	if _, err := NewRedactor(options.Redaction); err != nil {
+		return err
+	}
+	if options.LocalLog != "" && options.LocalLog != "journald" && options.LocalLog != "syslog" {
+		return errors.New("-local-log must be one of 'journald' and 'syslog'")
 	}
 	return nil
 }
 
 func (c *CLI) parseFlag(name string, args []string) (*Options, error) {
-	options := &Options{}
+	options := &Options{
+		Env: envFlag{},
+	}
 
 	fs := flag.NewFlagSet(name, flag.ContinueOnError)
 	fs.BoolVar(&options.ShowVersion, "version", false, "Show version")
 	fs.StringVar(&options.OutputLogGroup, "output-log-group", os.Getenv("PARAMEDIC_OUTPUT_LOG_GROUP"), "Output log group")
 	fs.StringVar(&options.OutputLogStreamPrefix, "output-log-stream-prefix", os.Getenv("PARAMEDIC_OUTPUT_LOG_STREAM_PREFIX"), "Output log stream prefix")
+	fs.StringVar(&options.OutputFormat, "output-format", "text", "Format of output log events (one of 'text' and 'json')")
 	fs.StringVar(&options.SignalS3Bucket, "signal-s3-bucket", os.Getenv("PARAMEDIC_SIGNAL_S3_BUCKET"), "Signal S3 bucket")
 	fs.StringVar(&options.SignalS3Key, "signal-s3-key", os.Getenv("PARAMEDIC_SIGNAL_S3_KEY"), "Signal S3 key")
+	fs.StringVar(&options.SignalSQSQueueURL, "signal-sqs-queue-url", os.Getenv("PARAMEDIC_SIGNAL_SQS_QUEUE_URL"), "SQS queue to receive signals from instead of the signal S3 object (optional)")
+	fs.StringVar(&options.SignalSQSEndpoint, "signal-sqs-endpoint", os.Getenv("PARAMEDIC_SIGNAL_SQS_ENDPOINT"), "Endpoint URL of SQS (for testing)")
+	fs.StringVar(&options.SignalFailureAction, "signal-failure-action", signalFailureActionFromEnv(), "Action on -signal-failure-limit consecutive failures of polling signals (one of 'keep', 'warn' and 'terminate')")
+	fs.StringVar(&options.SignalAckS3Bucket, "signal-ack-s3-bucket", os.Getenv("PARAMEDIC_SIGNAL_ACK_S3_BUCKET"), "Signal ack S3 bucket (defaults to -signal-s3-bucket)")
+	fs.StringVar(&options.SignalAckS3KeyPrefix, "signal-ack-s3-key-prefix", os.Getenv("PARAMEDIC_SIGNAL_ACK_S3_KEY_PREFIX"), "Prefix of signal ack S3 keys (optional)")
+	fs.StringVar(&options.ControlSocket, "control-socket", controlSocketFromEnv(), "Path of the local control socket (empty to disable)")
+	fs.StringVar(&options.SignalS3KeyPrefix, "signal-s3-key-prefix", os.Getenv("PARAMEDIC_SIGNAL_S3_KEY_PREFIX"), "Prefix of per-instance signal S3 keys, <prefix>/<instance id>.json (optional)")
 	fs.StringVar(&options.ScriptS3Bucket, "script-s3-bucket", os.Getenv("PARAMEDIC_SCRIPT_S3_BUCKET"), "Script S3 bucket")
 	fs.StringVar(&options.ScriptS3Key, "script-s3-key", os.Getenv("PARAMEDIC_SCRIPT_S3_KEY"), "Script S3 key")
+	fs.StringVar(&options.ManifestS3Bucket, "manifest-s3-bucket", os.Getenv("PARAMEDIC_MANIFEST_S3_BUCKET"), "Job manifest S3 bucket (defaults to -script-s3-bucket)")
+	fs.StringVar(&options.ManifestS3Key, "manifest-s3-key", os.Getenv("PARAMEDIC_MANIFEST_S3_KEY"), "Job manifest S3 key (optional)")
+	fs.StringVar(&options.TranscriptS3Bucket, "transcript-s3-bucket", os.Getenv("PARAMEDIC_TRANSCRIPT_S3_BUCKET"), "Transcript S3 bucket (optional)")
+	fs.StringVar(&options.TranscriptS3KeyPrefix, "transcript-s3-key-prefix", os.Getenv("PARAMEDIC_TRANSCRIPT_S3_KEY_PREFIX"), "Transcript S3 key prefix")
+	fs.StringVar(&options.TranscriptKMSKeyID, "transcript-kms-key-id", os.Getenv("PARAMEDIC_TRANSCRIPT_KMS_KEY_ID"), "KMS key ID to encrypt a transcript with (SSE-KMS)")
+	fs.BoolVar(&options.TranscriptGzip, "transcript-gzip", false, "Compress a transcript with gzip")
+	fs.StringVar(&options.FirehoseStream, "firehose-delivery-stream", os.Getenv("PARAMEDIC_FIREHOSE_DELIVERY_STREAM"), "Kinesis Data Firehose delivery stream to send output to (optional)")
+	fs.StringVar(&options.FirehoseEndpoint, "firehose-endpoint", os.Getenv("PARAMEDIC_FIREHOSE_ENDPOINT"), "Endpoint URL of Kinesis Data Firehose (for testing)")
+	fs.StringVar(&options.LocalLog, "local-log", os.Getenv("PARAMEDIC_LOCAL_LOG"), "Also forward output to a local log (one of 'journald' and 'syslog')")
+	fs.StringVar(&options.LocalLogAddress, "local-log-address", os.Getenv("PARAMEDIC_LOCAL_LOG_ADDRESS"), "Address of the local log (journald socket path or syslog address like 'udp://127.0.0.1:514')")
+	fs.StringVar(&options.ResultS3Bucket, "result-s3-bucket", os.Getenv("PARAMEDIC_RESULT_S3_BUCKET"), "Result S3 bucket (optional)")
+	fs.StringVar(&options.ResultS3KeyPrefix, "result-s3-key-prefix", os.Getenv("PARAMEDIC_RESULT_S3_KEY_PREFIX"), "Result S3 key prefix")
+	fs.StringVar(&options.StatusS3Bucket, "status-s3-bucket", os.Getenv("PARAMEDIC_STATUS_S3_BUCKET"), "Status S3 bucket (optional)")
+	fs.StringVar(&options.StatusS3KeyPrefix, "status-s3-key-prefix", os.Getenv("PARAMEDIC_STATUS_S3_KEY_PREFIX"), "Status S3 key prefix")
+	fs.StringVar(&options.RunID, "run-id", os.Getenv("PARAMEDIC_RUN_ID"), "Run ID (generated if empty)")
+	fs.BoolVar(&options.Redact, "redact", false, "Redact AWS access keys, bearer tokens, private keys and email addresses from output")
+	fs.Var(options.Env, "env", "Environment variable passed to the script as NAME=VALUE (VALUE can be ssm:/path/name) (repeatable)")
+	fs.BoolVar(&options.SecretsFile, "secrets-file", false, "Pass SSM parameters in a file given by PARAMEDIC_SECRETS_FILE instead of environment variables")
+	fs.StringVar(&options.InheritEnv, "inherit-env", "all", "Environment variables of the agent inherited by the script ('all', 'none' or comma-separated names)")
 	fs.StringVar(&options.AWSCredentialProvider, "credential-provider", "", "Credential provider (one of 'EC2Role')")
 	uploadIntervalStr := fs.String("upload-interval", "10s", "Interval to upload output")
 	signalIntervalStr := fs.String("signal-interval", "10s", "Interval to check signal")
+	signalFailureLimitStr := fs.String("signal-failure-limit", os.Getenv("PARAMEDIC_SIGNAL_FAILURE_LIMIT"), "Number of consecutive failures of polling signals to apply -signal-failure-action (0 to disable)")
+	shutdownGracePeriodStr := fs.String("shutdown-grace-period", defaultShutdownGracePeriod.String(), "Time for the script to exit after the agent forwards SIGTERM, SIGINT or SIGHUP to it")
 	err := fs.Parse(args)
 	if err != nil {
 		return nil, err
@@ -131,9 +229,35 @@ func (c *CLI) parseFlag(name string, args []string) (*Options, error) {
 	}
 	options.SignalInterval = d
 
+	d, err = time.ParseDuration(*shutdownGracePeriodStr)
+	if err != nil {
+		return nil, err
+	}
+	options.ShutdownGracePeriod = d
+
+	if *signalFailureLimitStr != "" {
+		n, err := strconv.Atoi(*signalFailureLimitStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -signal-failure-limit: %s", err)
+		}
+		options.SignalFailureLimit = n
+	}
+
+	if options.RunID == "" {
+		options.RunID = newRunID()
+	}
+
 	return options, nil
 }
 
+type awsClients struct {
+	s3       S3
+	cwlogs   CloudWatchLogs
+	firehose Firehose // nil unless -firehose-delivery-stream is given
+	ssm      SSM
+	sqs      SQS // nil unless -signal-sqs-queue-url is given
+}
+
 func (c *CLI) startWithOptions(options *Options) (error, int) {
 	log.Printf("[INFO] Starting paramedic-agent v%s", Version)
 
@@ -146,68 +270,422 @@ func (c *CLI) startWithOptions(options *Options) (error, int) {
 		sess.Config.Region = aws.String(region)
 	}
 
-	s3 := s3.New(sess)
-	cwlogs := cloudwatchlogs.New(sess)
+	clients := &awsClients{
+		s3:     s3.New(sess),
+		cwlogs: cloudwatchlogs.New(sess),
+		ssm:    ssm.New(sess),
+	}
+	if options.FirehoseStream != "" {
+		cfg := aws.NewConfig()
+		if options.FirehoseEndpoint != "" {
+			cfg = cfg.WithEndpoint(options.FirehoseEndpoint)
+		}
+		clients.firehose = firehose.New(sess, cfg)
+	}
+	if options.SignalSQSQueueURL != "" {
+		cfg := aws.NewConfig()
+		if options.SignalSQSEndpoint != "" {
+			cfg = cfg.WithEndpoint(options.SignalSQSEndpoint)
+		}
+		clients.sqs = sqs.New(sess, cfg)
+	}
+
+	result := newRunResult(options)
+	err, code := c.run(options, clients, result)
+
+	if options.ResultS3Bucket != "" {
+		result.FinishedAt = time.Now()
+		if err != nil {
+			result.Error = err.Error()
+		}
+		instanceID := result.InstanceID
+		if instanceID == "" {
+			instanceID, _ = os.Hostname()
+		}
+		key := runResultKey(options.ResultS3KeyPrefix, instanceID, result.RunID)
+		if err := uploadRunResult(clients.s3, options.ResultS3Bucket, key, result); err != nil {
+			log.Printf("[WARN] Failed to upload a result: %s", err)
+		}
+	}
+
+	return err, code
+}
+
+func (c *CLI) run(options *Options, clients *awsClients, result *runResult) (runErr error, code int) {
+	instanceID, err := fetchInstanceID()
+	if err != nil {
+		return err, agentExitCode
+	}
+	result.InstanceID = instanceID
 
 	watcher := SignalWatcher{
-		s3:       s3,
-		bucket:   options.SignalS3Bucket,
-		key:      options.SignalS3Key,
-		interval: options.SignalInterval,
+		interval:  options.SignalInterval,
+		runID:     options.RunID,
+		startedAt: time.Now(),
+
+		failureThreshold: options.SignalFailureLimit,
+		failureAction:    options.SignalFailureAction,
 	}
-	sig, err := watcher.Once()
+	var s3Channel *s3SignalChannel
+	if options.SignalS3Bucket != "" && options.SignalS3Key != "" {
+		s3Channel = &s3SignalChannel{
+			s3:     clients.s3,
+			bucket: options.SignalS3Bucket,
+			key:    options.SignalS3Key,
+		}
+		s3Channel.instanceKey = signalInstanceKey(options.SignalS3KeyPrefix, instanceID)
+		watcher.channel = s3Channel
+	}
+	if clients.sqs != nil {
+		sqsChannel := &sqsSignalChannel{
+			sqs:        clients.sqs,
+			queueURL:   options.SignalSQSQueueURL,
+			instanceID: instanceID,
+			waitTime:   sqsMaxWaitTime,
+		}
+		watcher.channel = sqsChannel
+		if s3Channel != nil {
+			// the shared object still reaches the whole fleet, since each
+			// message is received by only one agent
+			watcher.channel = multiSignalChannel{s3Channel, sqsChannel}
+		}
+		watcher.interval = 0 // receiving blocks by long polling
+	}
+	// without -status-s3-bucket, the status is kept only for the control socket
+	key := fmt.Sprintf("%s%s.json", options.StatusS3KeyPrefix, instanceID)
+	status := NewStatusReporter(clients.s3, options.StatusS3Bucket, key, instanceID, options.RunID)
+	status.Start()
+	defer func() {
+		if runErr != nil && code == agentExitCode {
+			status.Fail(runErr)
+		}
+		status.Close()
+	}()
+	status.Update(phaseStarted, nil)
+
+	var acker *SignalAcker
+	if options.SignalAckS3KeyPrefix != "" {
+		bucket := options.SignalAckS3Bucket
+		if bucket == "" {
+			bucket = options.SignalS3Bucket
+		}
+		acker = NewSignalAcker(clients.s3, bucket, options.SignalAckS3KeyPrefix, instanceID, options.RunID)
+	}
+	acker.Start()
+	defer acker.Close()
+
+	// only a signal for this run stops it before starting; leftovers are ignored
+	sig, err := watcher.poll(context.Background(), false)
 	if err != nil {
 		return err, agentExitCode
 	}
-	if sig != nil {
+	sig.settled()
+	if sig != nil && sig.invalid != nil {
+		log.Printf("[WARN] Ignoring an invalid signal object: %s", sig.invalid)
+		acker.Ignore(sig, sig.invalid.Error())
+	} else if sig != nil && sig.terminates() {
 		log.Printf("[INFO] Exiting because signal object is found before starting a command")
+		acker.Ack(sig, int(sig.number), nil, nil)
 		return nil, 0
+	} else if sig != nil {
+		log.Printf("[INFO] Ignoring %s found before starting a command", sig)
+		acker.Ignore(sig, "no script is running")
 	}
 
-	instanceID, err := fetchInstanceID()
+	manifest := &Manifest{}
+	if options.ManifestS3Key != "" {
+		bucket := options.ManifestS3Bucket
+		if bucket == "" {
+			bucket = options.ScriptS3Bucket
+		}
+		manifest, err = LoadManifest(clients.s3, bucket, options.ManifestS3Key)
+		if err != nil {
+			return err, agentExitCode
+		}
+		if err := validateSteps(manifest.Steps); err != nil {
+			return err, agentExitCode
+		}
+	}
+	if len(manifest.Steps) == 0 && options.ScriptS3Key == "" {
+		return errors.New("-script-s3-key is mandatory option without Steps in the manifest"), agentExitCode
+	}
+
+	redactor, err := NewRedactor(Redaction{BuiltinDetectors: options.Redact}, options.Redaction, manifest.Redaction)
 	if err != nil {
 		return err, agentExitCode
 	}
 
+	env := map[string]string{}
+	for k, v := range manifest.Environment {
+		env[k] = v
+	}
+	for k, v := range options.Env {
+		env[k] = v
+	}
+	plainEnv, secrets, err := resolveEnvironment(clients.ssm, env)
+	if err != nil {
+		return err, agentExitCode
+	}
+	redactor.AddLiterals(secretLiterals(secrets)...)
+
+	control := NewControlChannel()
+	output := NewOutput(redactor)
+	output.SetControlChannel(control)
+
+	var criteria *criteriaEvaluator
+	if manifest.SuccessCriteria.declared() {
+		criteria, err = newCriteriaEvaluator(manifest.SuccessCriteria)
+		if err != nil {
+			return err, agentExitCode
+		}
+		output.AddEntryWriter(criteria)
+	}
+
 	logStream := fmt.Sprintf("%s%s", options.OutputLogStreamPrefix, instanceID)
-	writer := NewCloudWatchLogsWriter(cwlogs, options.OutputLogGroup, logStream, options.UploadInterval)
+	writer := NewCloudWatchLogsWriter(clients.cwlogs, options.OutputLogGroup, logStream, options.UploadInterval)
+	if options.OutputFormat == "json" {
+		writer.EnableJSONFormat(instanceID, options.RunID)
+	}
 	if err := writer.Start(); err != nil {
 		return err, agentExitCode
 	}
 
-	cmd := NewCommand(s3, options.ScriptS3Bucket, options.ScriptS3Key, writer)
-	cmdCh, err := cmd.Start()
+	var router *LogRouter
+	var transcript *S3TranscriptWriter
+	var fhWriter *FirehoseWriter
+	var localLog *LocalLogWriter
+	stepLogs := newStepLogWriter(writer)
+	// signals to the agent are trapped until the writers are closed
+	shutdown := newShutdownFlag()
+	stopTrap := func() {}
+	// the output is flushed and the writers are closed on every return from here
+	defer func() {
+		flushed := flushWithin(func() {
+			output.Flush()
+			stepLogs.Close()
+			writer.Close()
+			if router != nil {
+				router.Close()
+			}
+			if fhWriter != nil {
+				fhWriter.Close()
+			}
+			if localLog != nil {
+				localLog.Close()
+			}
+			if transcript != nil {
+				if err := transcript.Close(); err != nil {
+					log.Printf("[WARN] Failed to upload a transcript: %s", err)
+				}
+			}
+		}, finalFlushTimeout, options.ShutdownGracePeriod, shutdown)
+		if flushed {
+			status.Update(phaseLogsFlushed, nil)
+		} else {
+			log.Printf("[WARN] Gave up flushing the output; the rest of it is lost")
+		}
+		stopTrap()
+	}()
+	output.AddEntryWriter(stepLogs)
+
+	if routes := append(options.LogRoutes, manifest.LogRoutes...); len(routes) > 0 {
+		router, err = NewLogRouter(routes, writer, instanceID)
+		if err != nil {
+			return err, agentExitCode
+		}
+		output.AddEntryWriter(router)
+	}
+
+	if options.TranscriptS3Bucket != "" {
+		key := fmt.Sprintf("%s%s.log", options.TranscriptS3KeyPrefix, instanceID)
+		if options.TranscriptGzip {
+			key += ".gz"
+		}
+		transcript = NewS3TranscriptWriter(clients.s3, options.TranscriptS3Bucket, key, options.TranscriptKMSKeyID, options.TranscriptGzip)
+		transcript.Start()
+		output.AddRawWriter(transcript)
+	}
+
+	if clients.firehose != nil {
+		fhWriter = NewFirehoseWriter(clients.firehose, options.FirehoseStream, instanceID, options.RunID, options.UploadInterval)
+		fhWriter.Start()
+		output.AddEntryWriter(fhWriter)
+	}
+
+	if options.LocalLog != "" {
+		fields := localLogFields{
+			RunID:      options.RunID,
+			InstanceID: instanceID,
+			LogStream:  logStream,
+		}
+		localLog, err = NewLocalLogWriter(options.LocalLog, options.LocalLogAddress, fields)
+		if err != nil {
+			log.Printf("[WARN] Failed to open the local log: %s", err)
+		} else {
+			localLog.Start()
+			output.AddEntryWriter(localLog)
+		}
+	}
+
+	if options.ControlSocket != "" {
+		controlServer, err := NewControlServer(options.ControlSocket, &watcher, status)
+		if err != nil {
+			log.Printf("[WARN] Failed to open the control socket: %s", err)
+		} else {
+			controlServer.Start()
+			defer controlServer.Close()
+			output.AddRawWriter(controlServer)
+		}
+	}
+
+	out := output.Stream(streamAgent)
+	workdir, err := ioutil.TempDir("", "paramedic-work")
 	if err != nil {
 		return err, agentExitCode
 	}
+	defer os.RemoveAll(workdir)
+
+	inheritEnv := options.InheritEnv
+	if manifest.InheritEnv != "" {
+		inheritEnv = manifest.InheritEnv
+	}
+
+	cmdEnv := scriptContextEnv(options, instanceID, logStream, workdir)
+	cmdEnv = append(cmdEnv, envList(plainEnv)...)
+	if len(secrets) > 0 {
+		if options.SecretsFile || manifest.SecretsFile {
+			path, err := writeSecretsFile(secrets)
+			if err != nil {
+				return err, agentExitCode
+			}
+			defer os.Remove(path)
+			cmdEnv = append(cmdEnv, "PARAMEDIC_SECRETS_FILE="+path)
+		} else {
+			cmdEnv = append(cmdEnv, envList(secrets)...)
+		}
+	}
 
-	signalCh := watcher.Start()
+	watcher.out = out
+	watcherCtx, cancelWatcher := context.WithCancel(context.Background())
+	stopWatcher := func() {
+		cancelWatcher()
+		watcher.Wait()
+	}
+	defer stopWatcher()
+	signalCh := watcher.Start(watcherCtx)
+
+	stopTrap = trapTermination(watcherCtx, signalCh, out, options.ShutdownGracePeriod, shutdown)
+
+	runner := &jobRunner{
+		clients:    clients,
+		output:     output,
+		stepLogs:   stepLogs,
+		out:        out,
+		stdout:     output.Stream(streamStdout),
+		stderr:     output.Stream(streamStderr),
+		signalCh:   signalCh,
+		status:     status,
+		acker:      acker,
+		criteria:   criteria,
+		inheritEnv: inheritEnv,
+		env:        cmdEnv,
+		shutdown:   shutdown,
+	}
 
 	var exitStatus int
 	var exitErr error
-
-L:
-	for {
-		select {
-		case err := <-cmdCh:
-			// command exited
-			exitStatus, exitErr = exitStatusFromError(err)
-			if exitErr == nil {
-				log.Printf("[INFO] The command exited with status %d", exitStatus)
-			}
-			break L
-		case signal := <-signalCh:
-			// send signal
-			cmd.Signal(syscall.Signal(signal.Signal))
+	if len(manifest.Steps) > 0 {
+		job, err := runner.runSteps(manifest.Steps, options.ScriptS3Bucket)
+		result.Steps = job.steps
+		if err != nil {
+			return err, agentExitCode
 		}
+		exitStatus, exitErr = job.exitStatus, job.exitErr
+	} else {
+		run, err := runner.runScript(options.ScriptS3Bucket, options.ScriptS3Key, 0, manifest.Retry, true)
+		if err == errAgentShuttingDown {
+			// terminated before the script started
+			exitStatus, exitErr = errorExitStatus, err
+		} else if err != nil {
+			return err, agentExitCode
+		} else {
+			exitStatus, exitErr = run.exitStatus, run.exitErr
+			result.ScriptVersion = run.version
+			result.ExitStatus = run.last.ExitStatus
+			result.Signal = run.last.Signal
+			result.TimedOut = run.last.TimedOut
+			result.Attempts = run.attempts
+		}
+	}
+	stopWatcher()
+	output.Flush()
+
+	result.BytesEmitted = output.Bytes()
+	result.LinesEmitted = output.Lines()
+	result.Outputs = control.Outputs()
+	if p := control.Progress(); p >= 0 {
+		result.Progress = aws.Int(p)
+	}
+	result.Warnings = control.Warnings()
+	for _, l := range control.Summary() {
+		fmt.Fprintln(out, l)
+	}
+	result.Redactions = redactor.Count()
+	if result.Redactions > 0 {
+		log.Printf("[INFO] %d secrets were redacted from the output", result.Redactions)
+		fmt.Fprintf(out, "[redacted: %d]\n", result.Redactions)
 	}
 
+	code = exitStatus
 	if exitErr == nil {
-		fmt.Fprintf(writer, "[exit status: %d]\n", exitStatus)
+		fmt.Fprintf(out, "[exit status: %d]\n", exitStatus)
+		if criteria != nil {
+			v := criteria.evaluate(exitStatus)
+			fmt.Fprintf(out, "[verdict: %s]\n", v)
+			result.Verdict = "failure"
+			if v.success {
+				result.Verdict = "success"
+			}
+			result.VerdictReason = v.reason
+			code = v.exitCode(exitStatus)
+		}
 	} else {
-		fmt.Fprintf(writer, "[%s]\n", exitErr)
+		fmt.Fprintf(out, "[%s]\n", exitErr)
+	}
+	if shutdown.isSet() {
+		log.Printf("[INFO] The agent is exiting after %s", shutdown.signal)
+		fmt.Fprintf(out, "[agent terminated by %s]\n", shutdown.signal)
+	}
+
+	return exitErr, code
+}
+
+// scriptContextEnv returns the PARAMEDIC_* variables describing the run to the script.
+func scriptContextEnv(options *Options, instanceID string, logStream string, workdir string) []string {
+	return []string{
+		"PARAMEDIC_INSTANCE_ID=" + instanceID,
+		"PARAMEDIC_RUN_ID=" + options.RunID,
+		"PARAMEDIC_LOG_GROUP=" + options.OutputLogGroup,
+		"PARAMEDIC_LOG_STREAM=" + logStream,
+		"PARAMEDIC_SIGNAL_S3_BUCKET=" + options.SignalS3Bucket,
+		"PARAMEDIC_SIGNAL_S3_KEY=" + options.SignalS3Key,
+		"PARAMEDIC_SIGNAL_S3_INSTANCE_KEY=" + signalInstanceKey(options.SignalS3KeyPrefix, instanceID),
+		"PARAMEDIC_AGENT_VERSION=" + Version,
+		"PARAMEDIC_WORKDIR=" + workdir,
 	}
-	writer.Close()
+}
 
-	return exitErr, exitStatus
+// signalInstanceKey returns the key of the per-instance signal object, or "" without -signal-s3-key-prefix.
+func signalInstanceKey(prefix string, instanceID string) string {
+	if prefix == "" {
+		return ""
+	}
+	return strings.TrimSuffix(prefix, "/") + "/" + instanceID + ".json"
+}
+
+func signalFailureActionFromEnv() string {
+	if a := os.Getenv("PARAMEDIC_SIGNAL_FAILURE_ACTION"); a != "" {
+		return a
+	}
+	return signalFailureKeep
 }
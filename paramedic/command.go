@@ -6,6 +6,7 @@ import (
 	"log"
 	"os"
 	"os/exec"
+	"syscall"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/s3"
@@ -15,40 +16,77 @@ type Command struct {
 	s3     S3
 	bucket string
 	key    string
-	writer io.Writer
+	stdout io.Writer
+	stderr io.Writer
+	env    []string
 
-	cmd *exec.Cmd
+	restrictEnv bool
+	inheritEnv  []string
+
+	cmd           *exec.Cmd
+	path          string
+	scriptVersion string
 }
 
-func NewCommand(s3 S3, bucket string, key string, writer io.Writer) *Command {
+func NewCommand(s3 S3, bucket string, key string, stdout io.Writer, stderr io.Writer) *Command {
 	return &Command{
 		s3:     s3,
 		bucket: bucket,
 		key:    key,
-		writer: writer,
+		stdout: stdout,
+		stderr: stderr,
 	}
 }
 
-func (c *Command) Start() (chan error, error) {
+// AddEnv adds environment variables in the form of "KEY=value" to the
+// environment inherited from the agent.
+func (c *Command) AddEnv(env ...string) {
+	c.env = append(c.env, env...)
+}
+
+// SetInheritEnv limits the agent's environment inherited by the script to the
+// variables in names. An empty list means a clean environment.
+func (c *Command) SetInheritEnv(names []string) {
+	c.restrictEnv = true
+	c.inheritEnv = names
+}
+
+// Download fetches the script into a temporary file.
+// Start calls it if it has not been called yet.
+func (c *Command) Download() error {
 	f, err := ioutil.TempFile("", "paramedic")
 	if err != nil {
-		return nil, err
+		return err
 	}
 	if err := os.Chmod(f.Name(), 0700); err != nil {
-		return nil, err
+		return err
 	}
 	if err := c.download(f); err != nil {
-		return nil, err
+		return err
 	}
 	if err := f.Close(); err != nil {
-		return nil, err
+		return err
+	}
+
+	c.path = f.Name()
+	return nil
+}
+
+func (c *Command) Start() (chan error, error) {
+	if c.path == "" {
+		if err := c.Download(); err != nil {
+			return nil, err
+		}
 	}
 
-	c.cmd = exec.Command(f.Name())
-	c.cmd.Stdout = c.writer
-	c.cmd.Stderr = c.writer
+	c.cmd = exec.Command(c.path)
+	c.cmd.Stdout = c.stdout
+	c.cmd.Stderr = c.stderr
+	c.cmd.Env = append(c.baseEnv(), c.env...)
+	// run the script in its own process group so that its whole tree can be signaled
+	c.cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 
-	log.Printf("[INFO] Starting %s", f.Name())
+	log.Printf("[INFO] Starting %s", c.path)
 	if err := c.cmd.Start(); err != nil {
 		return nil, err
 	}
@@ -56,16 +94,51 @@ func (c *Command) Start() (chan error, error) {
 	ch := make(chan error)
 	go func() {
 		ch <- c.cmd.Wait()
-		os.Remove(f.Name())
 	}()
 	return ch, nil
 }
 
+// Cleanup removes the downloaded script. Start can be called again until Cleanup is called.
+func (c *Command) Cleanup() {
+	if c.path != "" {
+		os.Remove(c.path)
+	}
+}
+
+func (c *Command) Pid() int {
+	return c.cmd.Process.Pid
+}
+
 func (c *Command) Signal(sig os.Signal) error {
 	log.Printf("[INFO] Signal %d is sent to pid %d", sig, c.cmd.Process.Pid)
 	return c.cmd.Process.Signal(sig)
 }
 
+// SignalGroup sends sig to the process group of the script.
+func (c *Command) SignalGroup(sig syscall.Signal) error {
+	log.Printf("[INFO] Signal %d is sent to process group %d", sig, c.cmd.Process.Pid)
+	return syscall.Kill(-c.cmd.Process.Pid, sig)
+}
+
+func (c *Command) baseEnv() []string {
+	if !c.restrictEnv {
+		return os.Environ()
+	}
+
+	env := []string{}
+	for _, name := range c.inheritEnv {
+		if v, ok := os.LookupEnv(name); ok {
+			env = append(env, name+"="+v)
+		}
+	}
+	return env
+}
+
+// ScriptVersion returns the S3 version ID (or ETag if versioning is disabled) of the downloaded script.
+func (c *Command) ScriptVersion() string {
+	return c.scriptVersion
+}
+
 func (c *Command) download(f *os.File) error {
 	log.Printf("[INFO] Downloading a script from s3://%s/%s to %s", c.bucket, c.key, f.Name())
 
@@ -84,5 +157,11 @@ func (c *Command) download(f *os.File) error {
 	}
 	output.Body.Close()
 
+	if output.VersionId != nil {
+		c.scriptVersion = *output.VersionId
+	} else if output.ETag != nil {
+		c.scriptVersion = *output.ETag
+	}
+
 	return nil
 }
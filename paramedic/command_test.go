@@ -0,0 +1,116 @@
+package paramedic
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/golang/mock/gomock"
+	"github.com/ryotarai/paramedic-agent/mock"
+)
+
+func TestJobRunner_Environment(t *testing.T) {
+	os.Setenv("PARAMEDIC_TEST_ALLOWED", "allowed")
+	os.Setenv("PARAMEDIC_TEST_HIDDEN", "hidden")
+	defer os.Unsetenv("PARAMEDIC_TEST_ALLOWED")
+	defer os.Unsetenv("PARAMEDIC_TEST_HIDDEN")
+
+	options := &Options{
+		RunID:             "run-1",
+		OutputLogGroup:    "g",
+		SignalS3Bucket:    "b",
+		SignalS3Key:       "signal.json",
+		SignalS3KeyPrefix: "signals/",
+	}
+	contextEnv := scriptContextEnv(options, "i-123", "paramedic/i-123", "/tmp/work")
+
+	cases := []struct {
+		inheritEnv string
+		present    []string
+		absent     []string
+	}{
+		{"all", []string{"PARAMEDIC_TEST_ALLOWED=allowed", "PARAMEDIC_TEST_HIDDEN=hidden"}, nil},
+		{"none", nil, []string{"PARAMEDIC_TEST_ALLOWED=", "PARAMEDIC_TEST_HIDDEN=", "HOME="}},
+		{"PARAMEDIC_TEST_ALLOWED,NOT_SET", []string{"PARAMEDIC_TEST_ALLOWED=allowed"}, []string{"PARAMEDIC_TEST_HIDDEN=", "NOT_SET="}},
+	}
+	for _, c := range cases {
+		mockCtrl := gomock.NewController(t)
+		s3m := mock.NewMockS3(mockCtrl)
+		body := &stringReadCloser{strings.NewReader("#!/bin/sh\n/usr/bin/env\n")}
+		s3m.EXPECT().GetObject(gomock.Any()).Return(&s3.GetObjectOutput{Body: body}, nil)
+
+		out := &bytes.Buffer{}
+		r := &jobRunner{
+			clients:    &awsClients{s3: s3m},
+			out:        out,
+			stdout:     out,
+			stderr:     out,
+			inheritEnv: c.inheritEnv,
+			env:        append(contextEnv, "APP_ENV=production"),
+		}
+		run, err := r.runScript("b", "script", 0, RetryPolicy{}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if run.exitStatus != 0 || run.exitErr != nil {
+			t.Errorf("%s: got exit status %d (%v)\n%s", c.inheritEnv, run.exitStatus, run.exitErr, out.String())
+		}
+
+		lines := strings.Split(out.String(), "\n")
+		has := func(prefix string) bool {
+			for _, l := range lines {
+				if strings.HasPrefix(l, prefix) {
+					return true
+				}
+			}
+			return false
+		}
+		present := append(c.present, "APP_ENV=production", "PARAMEDIC_INSTANCE_ID=i-123", "PARAMEDIC_RUN_ID=run-1",
+			"PARAMEDIC_LOG_STREAM=paramedic/i-123", "PARAMEDIC_SIGNAL_S3_KEY=signal.json",
+			"PARAMEDIC_SIGNAL_S3_INSTANCE_KEY=signals/i-123.json", "PARAMEDIC_WORKDIR=/tmp/work")
+		for _, v := range present {
+			if !has(v) {
+				t.Errorf("%s: %s is not in the environment:\n%s", c.inheritEnv, v, out.String())
+			}
+		}
+		for _, v := range c.absent {
+			if has(v) {
+				t.Errorf("%s: %s should not be inherited:\n%s", c.inheritEnv, v, out.String())
+			}
+		}
+		mockCtrl.Finish()
+	}
+}
+
+func TestJobRunner_TimeoutKillsProcessGroup(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	s3m := mock.NewMockS3(mockCtrl)
+	// the background child keeps stdout open until it is killed
+	body := &stringReadCloser{strings.NewReader("#!/bin/sh\nsleep 30 &\nsleep 30\n")}
+	s3m.EXPECT().GetObject(gomock.Any()).Return(&s3.GetObjectOutput{Body: body}, nil)
+
+	out := &bytes.Buffer{}
+	r := &jobRunner{
+		clients:    &awsClients{s3: s3m},
+		out:        out,
+		stdout:     ioutil.Discard,
+		stderr:     ioutil.Discard,
+		inheritEnv: "all",
+	}
+	start := time.Now()
+	run, err := r.runScript("b", "script", time.Second, RetryPolicy{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("the script took %s; children should be killed on timeout", elapsed)
+	}
+	if run.exitStatus == 0 || !strings.Contains(out.String(), "[timed out after 1s]") {
+		t.Errorf("got exit status %d but expected a timeout:\n%s", run.exitStatus, out.String())
+	}
+}
@@ -7,7 +7,9 @@ import (
 )
 
 type Config struct {
-	AWSCredentialProvider string `yaml:"AWSCredentialProvider"` // one of "" and "EC2Role"
+	AWSCredentialProvider string     `yaml:"AWSCredentialProvider"` // one of "" and "EC2Role"
+	LogRoutes             []LogRoute `yaml:"LogRoutes"`
+	Redaction             Redaction  `yaml:"Redaction"`
 }
 
 func LoadConfig(path string) (*Config, error) {
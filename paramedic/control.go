@@ -0,0 +1,109 @@
+package paramedic
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// controlPrefix marks a line written by the script as a command to the agent, e.g.
+//
+//	::paramedic::set-output key=value
+//	::paramedic::progress 42
+//	::paramedic::warning disk usage is high
+const controlPrefix = "::paramedic::"
+
+// ControlChannel collects structured information reported by the script.
+// Recognized control lines are stripped from the output.
+type ControlChannel struct {
+	outputs  map[string]string
+	progress int // -1 if not reported
+	warnings []string
+	mutex    sync.Mutex
+}
+
+func NewControlChannel() *ControlChannel {
+	return &ControlChannel{
+		outputs:  map[string]string{},
+		progress: -1,
+		warnings: []string{},
+		mutex:    sync.Mutex{},
+	}
+}
+
+// handle returns true if line is a control line and should be stripped.
+func (c *ControlChannel) handle(line string) bool {
+	if !strings.HasPrefix(line, controlPrefix) {
+		return false
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(line, controlPrefix), " ", 2)
+	command := parts[0]
+	arg := ""
+	if len(parts) == 2 {
+		arg = strings.TrimSpace(parts[1])
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	switch command {
+	case "set-output":
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return false
+		}
+		c.outputs[kv[0]] = kv[1]
+	case "progress":
+		p, err := strconv.Atoi(strings.TrimSuffix(arg, "%"))
+		if err != nil || p < 0 || p > 100 {
+			return false
+		}
+		c.progress = p
+	case "warning":
+		c.warnings = append(c.warnings, arg)
+	default:
+		return false
+	}
+	return true
+}
+
+func (c *ControlChannel) Outputs() map[string]string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	outputs := map[string]string{}
+	for k, v := range c.outputs {
+		outputs[k] = v
+	}
+	return outputs
+}
+
+// Progress returns the last reported percentage, or -1 if not reported.
+func (c *ControlChannel) Progress() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.progress
+}
+
+func (c *ControlChannel) Warnings() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]string{}, c.warnings...)
+}
+
+// Summary returns lines summarizing what the script reported.
+func (c *ControlChannel) Summary() []string {
+	lines := []string{}
+	outputs := c.Outputs()
+	for _, k := range sortedKeys(outputs) {
+		lines = append(lines, "[output: "+k+"="+outputs[k]+"]")
+	}
+	if p := c.Progress(); p >= 0 {
+		lines = append(lines, "[progress: "+strconv.Itoa(p)+"%]")
+	}
+	for _, w := range c.Warnings() {
+		lines = append(lines, "[warning: "+w+"]")
+	}
+	return lines
+}
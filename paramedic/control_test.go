@@ -0,0 +1,99 @@
+package paramedic
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestControlChannel_Handle(t *testing.T) {
+	cases := []struct {
+		line     string
+		stripped bool
+	}{
+		{"::paramedic::set-output drained=true", true},
+		{"::paramedic::set-output url=http://example.com/?a=b", true},
+		{"::paramedic::progress 50", true},
+		{"::paramedic::progress 75%", true},
+		{"::paramedic::warning disk usage is above 90%", true},
+		// malformed lines are kept in the output
+		{"::paramedic::set-output novalue", false},
+		{"::paramedic::set-output =value", false},
+		{"::paramedic::progress half", false},
+		{"::paramedic::progress 101", false},
+		{"::paramedic::progress -1", false},
+		{"::paramedic::unknown x", false},
+		{"::paramedic::", false},
+		{"  ::paramedic::progress 10", false},
+		{"plain line", false},
+	}
+
+	c := NewControlChannel()
+	for _, tc := range cases {
+		if got := c.handle(tc.line); got != tc.stripped {
+			t.Errorf("handle(%q) = %v but expected %v", tc.line, got, tc.stripped)
+		}
+	}
+
+	outputs := c.Outputs()
+	if len(outputs) != 2 || outputs["drained"] != "true" || outputs["url"] != "http://example.com/?a=b" {
+		t.Errorf("got outputs %v", outputs)
+	}
+	if c.Progress() != 75 {
+		t.Errorf("got progress %d but expected 75", c.Progress())
+	}
+	if w := c.Warnings(); len(w) != 1 || w[0] != "disk usage is above 90%" {
+		t.Errorf("got warnings %q", w)
+	}
+
+	expected := []string{
+		"[output: drained=true]",
+		"[output: url=http://example.com/?a=b]",
+		"[progress: 75%]",
+		"[warning: disk usage is above 90%]",
+	}
+	if got := c.Summary(); strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("got summary %q but expected %q", got, expected)
+	}
+}
+
+func TestControlChannel_NotReported(t *testing.T) {
+	c := NewControlChannel()
+	if c.Progress() != -1 || len(c.Outputs()) != 0 || len(c.Warnings()) != 0 || len(c.Summary()) != 0 {
+		t.Errorf("nothing should be reported")
+	}
+}
+
+func TestOutput_StripsControlLines(t *testing.T) {
+	c := NewControlChannel()
+	o := NewOutput(nil)
+	o.SetControlChannel(c)
+	entries := &entryRecorder{}
+	o.AddEntryWriter(entries)
+	raw := &bytes.Buffer{}
+	o.AddRawWriter(raw)
+
+	stdout := o.Stream(streamStdout)
+	stdout.Write([]byte("before\n::paramedic::set-out"))
+	stdout.Write([]byte("put key=value\n::paramedic::bogus\n"))
+	o.Stream(streamStderr).Write([]byte("::paramedic::warning from stderr\n"))
+	// lines written by the agent are never handled as control lines
+	o.Stream(streamAgent).Write([]byte("::paramedic::progress 10\n"))
+	stdout.Write([]byte("::paramedic::progress 20"))
+	o.Flush()
+
+	texts := []string{}
+	for _, e := range entries.entries {
+		texts = append(texts, e.text)
+	}
+	expected := []string{"before", "::paramedic::bogus", "::paramedic::progress 10"}
+	if strings.Join(texts, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("got %q but expected %q", texts, expected)
+	}
+	if raw.String() != "before\n::paramedic::bogus\n::paramedic::progress 10\n" {
+		t.Errorf("got raw output %q", raw.String())
+	}
+	if c.Outputs()["key"] != "value" || c.Progress() != 20 || len(c.Warnings()) != 1 {
+		t.Errorf("got %v, %d and %q", c.Outputs(), c.Progress(), c.Warnings())
+	}
+}
@@ -0,0 +1,131 @@
+package paramedic
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// isControlCommand reports whether name is a subcommand talking to a running agent.
+func isControlCommand(name string) bool {
+	switch name {
+	case controlCommandSignal, controlCommandStatus, controlCommandAttach:
+		return true
+	}
+	return false
+}
+
+// control runs a subcommand talking to a running agent through the control socket:
+//
+//	paramedic-agent signal [-action action] [-duration duration] [signal]
+//	paramedic-agent status
+//	paramedic-agent attach
+func (c *CLI) control(command string, args []string) int {
+	fs := flag.NewFlagSet(command, flag.ContinueOnError)
+	socket := fs.String("socket", controlSocketFromEnv(), "Path of the control socket")
+	var action, duration *string
+	if command == controlCommandSignal {
+		action = fs.String("action", "", "Action of the signal (defaults to 'signal')")
+		duration = fs.String("duration", "", "Duration for extend-timeout and escalate")
+	}
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+
+	req := controlRequest{Command: command}
+	if command == controlCommandSignal {
+		data, err := signalObjectFromArgs(*action, *duration, fs.Args())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			return 1
+		}
+		req.Signal = data
+	}
+
+	if err := c.sendControlRequest(*socket, req, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+	return 0
+}
+
+func (c *CLI) sendControlRequest(socket string, req controlRequest, out io.Writer) error {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return fmt.Errorf("failed to connect to the agent: %s", err)
+	}
+	defer conn.Close()
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(conn)
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return err
+	}
+	resp := controlResponse{}
+	if err := json.Unmarshal(line, &resp); err != nil {
+		return err
+	}
+	if resp.Error != "" {
+		return errors.New(resp.Error)
+	}
+
+	switch req.Command {
+	case controlCommandStatus:
+		b, err := json.MarshalIndent(resp.Status, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "%s\n", b)
+	case controlCommandAttach:
+		// until the agent exits or the client is interrupted
+		io.Copy(out, r)
+	}
+	return nil
+}
+
+// signalObjectFromArgs builds a signal object from the arguments of the
+// signal subcommand. A signal object in JSON is also accepted as is.
+func signalObjectFromArgs(action string, duration string, args []string) (json.RawMessage, error) {
+	if len(args) > 1 {
+		return nil, errors.New("too many arguments")
+	}
+	if len(args) == 1 && strings.HasPrefix(strings.TrimSpace(args[0]), "{") {
+		return json.RawMessage(args[0]), nil
+	}
+
+	obj := map[string]interface{}{
+		"version": signalSchemaVersion,
+	}
+	if action != "" {
+		obj["action"] = action
+	}
+	if duration != "" {
+		obj["duration"] = duration
+	}
+	if len(args) == 1 {
+		if n, err := strconv.Atoi(args[0]); err == nil {
+			obj["signal"] = n
+		} else {
+			obj["signal"] = args[0]
+		}
+	}
+	return json.Marshal(obj)
+}
+
+func controlSocketFromEnv() string {
+	if s := os.Getenv("PARAMEDIC_CONTROL_SOCKET"); s != "" {
+		return s
+	}
+	return defaultControlSocket
+}
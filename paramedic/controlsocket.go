@@ -0,0 +1,223 @@
+package paramedic
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultControlSocket = "/var/run/paramedic-agent.sock"
+
+	controlCommandSignal = "signal"
+	controlCommandStatus = "status"
+	controlCommandAttach = "attach"
+
+	// chunks of output buffered for each attached client; slower clients are detached
+	controlAttachBuffer = 256
+)
+
+type controlRequest struct {
+	Command string          `json:"command"`
+	Signal  json.RawMessage `json:"signal,omitempty"` // signal object for "signal"
+}
+
+type controlResponse struct {
+	Error  string          `json:"error,omitempty"`
+	Status *instanceStatus `json:"status,omitempty"`
+}
+
+// ControlServer serves the local control socket, through which an engineer on
+// the instance can signal the script, see the status and tail the output.
+// Being a raw writer of Output, it relays the output to attached clients.
+type ControlServer struct {
+	path     string
+	listener net.Listener
+	watcher  *SignalWatcher
+	status   *StatusReporter
+	attached map[net.Conn]chan []byte // output to be written to each client
+	mutex    sync.Mutex
+	sequence int
+}
+
+// NewControlServer listens on a Unix socket at path accessible only by the owner (root).
+func NewControlServer(path string, watcher *SignalWatcher, status *StatusReporter) (*ControlServer, error) {
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("control socket %s is in use by another agent", path)
+	}
+	// remove a socket left by an agent which did not exit cleanly, but nothing else
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	// the socket is created with 0600 from the start
+	umask := syscall.Umask(0177)
+	l, err := net.Listen("unix", path)
+	syscall.Umask(umask)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ControlServer{
+		path:     path,
+		listener: l,
+		watcher:  watcher,
+		status:   status,
+		attached: map[net.Conn]chan []byte{},
+		mutex:    sync.Mutex{},
+	}, nil
+}
+
+func (s *ControlServer) Start() {
+	go func() {
+		for {
+			conn, err := s.listener.Accept()
+			if err != nil {
+				return // closed
+			}
+			go s.handle(conn)
+		}
+	}()
+}
+
+func (s *ControlServer) handle(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	req := controlRequest{}
+	if err := json.NewDecoder(r).Decode(&req); err != nil {
+		s.respond(conn, controlResponse{Error: err.Error()})
+		conn.Close()
+		return
+	}
+	log.Printf("[INFO] A control request is received: %s", req.Command)
+
+	switch req.Command {
+	case controlCommandSignal:
+		resp := controlResponse{}
+		if err := s.signal(req.Signal); err != nil {
+			resp.Error = err.Error()
+		}
+		s.respond(conn, resp)
+	case controlCommandStatus:
+		status := s.status.Snapshot()
+		s.respond(conn, controlResponse{Status: &status})
+	case controlCommandAttach:
+		s.respond(conn, controlResponse{})
+		ch := make(chan []byte, controlAttachBuffer)
+		s.mutex.Lock()
+		s.attached[conn] = ch
+		s.mutex.Unlock()
+		go s.relay(conn, ch)
+		// wait for the client to go away
+		io.Copy(ioutil.Discard, r)
+		s.detach(conn)
+		return
+	default:
+		s.respond(conn, controlResponse{Error: fmt.Sprintf("unknown command %q", req.Command)})
+	}
+	conn.Close()
+}
+
+func (s *ControlServer) signal(data json.RawMessage) error {
+	sig, err := parseSignalObject(data)
+	if err != nil {
+		return err
+	}
+	if sig.invalid != nil {
+		return sig.invalid
+	}
+
+	s.mutex.Lock()
+	s.sequence++
+	sig.identity = fmt.Sprintf("local:%d", s.sequence)
+	s.mutex.Unlock()
+	if sig.ID != "" {
+		sig.identity = "local id:" + sig.ID
+	}
+	return s.watcher.Deliver(sig)
+}
+
+func (s *ControlServer) respond(conn net.Conn, resp controlResponse) {
+	if err := json.NewEncoder(conn).Encode(resp); err != nil {
+		log.Printf("[WARN] Failed to respond to a control request: %s", err)
+	}
+}
+
+// relay writes the output buffered in ch to an attached client until it is
+// detached, and then closes the connection.
+func (s *ControlServer) relay(conn net.Conn, ch chan []byte) {
+	defer conn.Close()
+	failed := false
+	for p := range ch {
+		if failed {
+			continue
+		}
+		conn.SetWriteDeadline(time.Now().Add(time.Second))
+		if _, err := conn.Write(p); err != nil {
+			log.Printf("[INFO] Detaching a client of the control socket: %s", err)
+			failed = true
+			s.detach(conn)
+		}
+	}
+}
+
+func (s *ControlServer) detach(conn net.Conn) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.detachLocked(conn)
+}
+
+func (s *ControlServer) detachLocked(conn net.Conn) {
+	if ch, ok := s.attached[conn]; ok {
+		delete(s.attached, conn)
+		close(ch) // relay closes the connection
+	}
+}
+
+// Write relays the output to attached clients without waiting for them.
+// Clients falling behind by more than controlAttachBuffer chunks are detached.
+func (s *ControlServer) Write(p []byte) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.attached) == 0 {
+		return len(p), nil
+	}
+
+	chunk := make([]byte, len(p))
+	copy(chunk, p)
+	for conn, ch := range s.attached {
+		select {
+		case ch <- chunk:
+		default:
+			log.Printf("[INFO] Detaching a client of the control socket: too slow")
+			s.detachLocked(conn)
+		}
+	}
+	return len(p), nil
+}
+
+func (s *ControlServer) Close() error {
+	err := s.listener.Close()
+
+	s.mutex.Lock()
+	for conn := range s.attached {
+		s.detachLocked(conn)
+	}
+	s.mutex.Unlock()
+
+	os.Remove(s.path)
+	return err
+}
@@ -0,0 +1,159 @@
+package paramedic
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestControlServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "paramedic-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "agent.sock")
+
+	watcher := &SignalWatcher{ch: make(chan *signal, 1)}
+	status := NewStatusReporter(nil, "", "", "i-123", "run-1")
+	status.Update(phaseRunning, nil)
+
+	s, err := NewControlServer(path, watcher, status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Start()
+	defer s.Close()
+
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("the control socket should be accessible only by the owner: %v %v", fi.Mode(), err)
+	}
+
+	c := &CLI{}
+	data, _ := signalObjectFromArgs("", "", []string{"TERM"})
+	if err := c.sendControlRequest(path, controlRequest{Command: controlCommandSignal, Signal: data}, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	sig := <-watcher.ch
+	if sig.number != syscall.SIGTERM {
+		t.Errorf("got signal %d but expected %d", sig.number, syscall.SIGTERM)
+	}
+
+	data, _ = signalObjectFromArgs("reboot", "", nil)
+	if err := c.sendControlRequest(path, controlRequest{Command: controlCommandSignal, Signal: data}, ioutil.Discard); err == nil {
+		t.Errorf("an unknown action should be rejected")
+	}
+
+	out := &bytes.Buffer{}
+	if err := c.sendControlRequest(path, controlRequest{Command: controlCommandStatus}, out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), `"phase": "running"`) {
+		t.Errorf("unexpected status:\n%s", out.String())
+	}
+}
+
+func TestControlServer_RefusesToRemoveNonSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "paramedic-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "agent.sock")
+	if err := ioutil.WriteFile(path, []byte("precious"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewControlServer(path, &SignalWatcher{}, nil); err == nil {
+		t.Errorf("a regular file at the socket path should be refused")
+	}
+	if data, err := ioutil.ReadFile(path); err != nil || string(data) != "precious" {
+		t.Errorf("the file should be left as it is: %q %v", data, err)
+	}
+}
+
+func TestControlServer_Attach(t *testing.T) {
+	dir, err := ioutil.TempDir("", "paramedic-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "agent.sock")
+
+	s, err := NewControlServer(path, &SignalWatcher{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Start()
+	defer s.Close()
+
+	attach := func() net.Conn {
+		conn, err := net.Dial("unix", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		json.NewEncoder(conn).Encode(controlRequest{Command: controlCommandAttach})
+		if _, err := bufio.NewReader(conn).ReadString('\n'); err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	// one client reads the output and the other never does
+	reader := attach()
+	defer reader.Close()
+	stalled := attach()
+	defer stalled.Close()
+	for i := 0; ; i++ {
+		s.mutex.Lock()
+		n := len(s.attached)
+		s.mutex.Unlock()
+		if n == 2 {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("got %d attached clients but expected 2", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	received := make(chan int)
+	go func() {
+		n, _ := io.Copy(ioutil.Discard, reader)
+		received <- int(n)
+	}()
+
+	chunk := bytes.Repeat([]byte("x"), 64*1024)
+	start := time.Now()
+	for i := 0; i < 2*controlAttachBuffer; i++ {
+		s.Write(chunk)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("writing the output took %s; it should not wait for clients", elapsed)
+	}
+
+	s.mutex.Lock()
+	_, ok := s.attached[stalled]
+	s.mutex.Unlock()
+	if ok {
+		t.Errorf("the stalled client should be detached")
+	}
+
+	s.Close()
+	select {
+	case n := <-received:
+		if n == 0 {
+			t.Errorf("the reading client received no output")
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("the reading client was not disconnected")
+	}
+}
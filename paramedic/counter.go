@@ -0,0 +1,28 @@
+package paramedic
+
+import (
+	"bytes"
+	"io"
+	"sync/atomic"
+)
+
+// countingWriter counts bytes and lines written through it.
+type countingWriter struct {
+	writer io.Writer
+	bytes  int64
+	lines  int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	atomic.AddInt64(&w.bytes, int64(len(p)))
+	atomic.AddInt64(&w.lines, int64(bytes.Count(p, []byte("\n"))))
+	return w.writer.Write(p)
+}
+
+func (w *countingWriter) Bytes() int64 {
+	return atomic.LoadInt64(&w.bytes)
+}
+
+func (w *countingWriter) Lines() int64 {
+	return atomic.LoadInt64(&w.lines)
+}
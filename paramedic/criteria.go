@@ -0,0 +1,138 @@
+package paramedic
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+)
+
+// SuccessCriteria decides whether a run succeeded beyond its exit status.
+type SuccessCriteria struct {
+	ExitCodes      []int    `yaml:"ExitCodes"` // accepted exit codes (defaults to [0])
+	MustContain    []string `yaml:"MustContain"`
+	MustNotContain []string `yaml:"MustNotContain"`
+}
+
+func (c *SuccessCriteria) declared() bool {
+	return len(c.ExitCodes) > 0 || len(c.MustContain) > 0 || len(c.MustNotContain) > 0
+}
+
+type verdict struct {
+	success bool
+	reason  string
+}
+
+func (v verdict) String() string {
+	if v.success {
+		return "success"
+	}
+	return fmt.Sprintf("failure (%s)", v.reason)
+}
+
+// criteriaEvaluator checks output expectations while the output is streamed.
+type criteriaEvaluator struct {
+	exitCodes      []int
+	mustContain    []*regexp.Regexp
+	mustNotContain []*regexp.Regexp
+
+	contained    []bool
+	notContained string // reason of the first match of MustNotContain
+	mutex        sync.Mutex
+}
+
+func newCriteriaEvaluator(c SuccessCriteria) (*criteriaEvaluator, error) {
+	e := &criteriaEvaluator{
+		exitCodes: c.ExitCodes,
+		mutex:     sync.Mutex{},
+	}
+	if len(e.exitCodes) == 0 {
+		e.exitCodes = []int{0}
+	}
+	for _, p := range c.MustContain {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid MustContain pattern: %s", err)
+		}
+		e.mustContain = append(e.mustContain, re)
+	}
+	for _, p := range c.MustNotContain {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid MustNotContain pattern: %s", err)
+		}
+		e.mustNotContain = append(e.mustNotContain, re)
+	}
+	e.contained = make([]bool, len(e.mustContain))
+
+	return e, nil
+}
+
+// reset forgets the output seen so far, e.g. before retrying.
+func (e *criteriaEvaluator) reset() {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.contained = make([]bool, len(e.mustContain))
+	e.notContained = ""
+}
+
+func (e *criteriaEvaluator) writeEntries(entries []logEntry) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	for _, entry := range entries {
+		if entry.stream == streamAgent {
+			continue
+		}
+		for i, re := range e.mustContain {
+			if !e.contained[i] && re.MatchString(entry.text) {
+				e.contained[i] = true
+			}
+		}
+		if e.notContained != "" {
+			continue
+		}
+		for _, re := range e.mustNotContain {
+			if re.MatchString(entry.text) {
+				e.notContained = fmt.Sprintf("line %d matched %q", entry.line, re.String())
+				break
+			}
+		}
+	}
+}
+
+func (e *criteriaEvaluator) evaluate(exitStatus int) verdict {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	accepted := false
+	for _, c := range e.exitCodes {
+		if c == exitStatus {
+			accepted = true
+			break
+		}
+	}
+	if !accepted {
+		return verdict{reason: fmt.Sprintf("exit status %d is not accepted", exitStatus)}
+	}
+	if e.notContained != "" {
+		return verdict{reason: e.notContained}
+	}
+	for i, re := range e.mustContain {
+		if !e.contained[i] {
+			return verdict{reason: fmt.Sprintf("no line matched %q", re.String())}
+		}
+	}
+	return verdict{success: true}
+}
+
+// exitCode returns the exit code of the agent for the verdict.
+func (v verdict) exitCode(exitStatus int) int {
+	if v.success {
+		return 0
+	}
+	if exitStatus != 0 {
+		return exitStatus
+	}
+	return 1
+}
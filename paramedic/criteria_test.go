@@ -0,0 +1,133 @@
+package paramedic
+
+import (
+	"testing"
+)
+
+func TestCriteriaEvaluator(t *testing.T) {
+	cases := []struct {
+		name       string
+		criteria   SuccessCriteria
+		chunks     []string // written to stdout as they are
+		exitStatus int
+		success    bool
+		reason     string
+	}{
+		{
+			name:       "default exit code",
+			criteria:   SuccessCriteria{MustContain: []string{"x"}},
+			chunks:     []string{"x\n"},
+			exitStatus: 0,
+			success:    true,
+		},
+		{
+			name:       "not accepted",
+			criteria:   SuccessCriteria{MustContain: []string{"x"}},
+			chunks:     []string{"x\n"},
+			exitStatus: 1,
+			reason:     "exit status 1 is not accepted",
+		},
+		{
+			name:       "accepted exit code",
+			criteria:   SuccessCriteria{ExitCodes: []int{0, 3}},
+			exitStatus: 3,
+			success:    true,
+		},
+		{
+			name:       "must contain across chunks",
+			criteria:   SuccessCriteria{MustContain: []string{"^done$", "ok"}},
+			chunks:     []string{"o", "k\nd", "o", "ne\n"},
+			exitStatus: 0,
+			success:    true,
+		},
+		{
+			name:       "must contain in the last line without newline",
+			criteria:   SuccessCriteria{MustContain: []string{"^done$"}},
+			chunks:     []string{"working\ndo", "ne"},
+			exitStatus: 0,
+			success:    true,
+		},
+		{
+			name:       "must contain is line based",
+			criteria:   SuccessCriteria{MustContain: []string{"do.*ne"}},
+			chunks:     []string{"do\nne\n"},
+			exitStatus: 0,
+			reason:     `no line matched "do.*ne"`,
+		},
+		{
+			name:       "must not contain across chunks",
+			criteria:   SuccessCriteria{MustNotContain: []string{"FATAL"}},
+			chunks:     []string{"ok\nFA", "TAL: broken\n"},
+			exitStatus: 0,
+			reason:     `line 2 matched "FATAL"`,
+		},
+		{
+			name:       "must not contain wins over must contain",
+			criteria:   SuccessCriteria{MustContain: []string{"done"}, MustNotContain: []string{"FATAL", "ERROR"}},
+			chunks:     []string{"ERROR\nFATAL\ndone\n"},
+			exitStatus: 0,
+			reason:     `line 1 matched "ERROR"`,
+		},
+	}
+
+	for _, c := range cases {
+		e, err := newCriteriaEvaluator(c.criteria)
+		if err != nil {
+			t.Fatal(err)
+		}
+		o := NewOutput(nil)
+		o.AddEntryWriter(e)
+		stdout := o.Stream(streamStdout)
+		for _, chunk := range c.chunks {
+			stdout.Write([]byte(chunk))
+		}
+		// lines written by the agent are not evaluated
+		o.Stream(streamAgent).Write([]byte("FATAL done ok\n"))
+		o.Flush()
+
+		v := e.evaluate(c.exitStatus)
+		if v.success != c.success || v.reason != c.reason {
+			t.Errorf("%s: got %s but expected %v (%s)", c.name, v, c.success, c.reason)
+		}
+	}
+}
+
+func TestCriteriaEvaluator_Reset(t *testing.T) {
+	e, err := newCriteriaEvaluator(SuccessCriteria{MustContain: []string{"done"}, MustNotContain: []string{"FATAL"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.writeEntries([]logEntry{{text: "FATAL", stream: streamStdout, line: 1}})
+	e.reset()
+	e.writeEntries([]logEntry{{text: "done", stream: streamStdout, line: 2}})
+	if v := e.evaluate(0); !v.success {
+		t.Errorf("got %s but expected success after reset", v)
+	}
+}
+
+func TestNewCriteriaEvaluator_InvalidPattern(t *testing.T) {
+	if _, err := newCriteriaEvaluator(SuccessCriteria{MustContain: []string{"("}}); err == nil {
+		t.Error("expected an error for MustContain")
+	}
+	if _, err := newCriteriaEvaluator(SuccessCriteria{MustNotContain: []string{"("}}); err == nil {
+		t.Error("expected an error for MustNotContain")
+	}
+}
+
+func TestVerdictExitCode(t *testing.T) {
+	cases := []struct {
+		verdict    verdict
+		exitStatus int
+		expected   int
+	}{
+		{verdict{success: true}, 0, 0},
+		{verdict{success: true}, 3, 0}, // an accepted exit code
+		{verdict{reason: "not accepted"}, 2, 2},
+		{verdict{reason: "no line matched"}, 0, 1},
+	}
+	for _, c := range cases {
+		if got := c.verdict.exitCode(c.exitStatus); got != c.expected {
+			t.Errorf("%s with exit status %d: got %d but expected %d", c.verdict, c.exitStatus, got, c.expected)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package paramedic
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type processInfo struct {
+	pid     int
+	ppid    int
+	state   string
+	command string
+}
+
+// processGroup lists processes in the process group pgid by reading /proc.
+func processGroup(pgid int) ([]processInfo, error) {
+	stats, err := filepath.Glob("/proc/[0-9]*/stat")
+	if err != nil {
+		return nil, err
+	}
+	if len(stats) == 0 {
+		return nil, fmt.Errorf("/proc is not available")
+	}
+
+	procs := []processInfo{}
+	for _, path := range stats {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue // the process has exited
+		}
+		p, group, ok := parseProcStat(string(b))
+		if !ok || group != pgid {
+			continue
+		}
+		procs = append(procs, p)
+	}
+	sort.Slice(procs, func(i, j int) bool { return procs[i].pid < procs[j].pid })
+	return procs, nil
+}
+
+// parseProcStat parses /proc/<pid>/stat and returns the process and its process group.
+func parseProcStat(stat string) (processInfo, int, bool) {
+	// the command is in parentheses and may contain spaces
+	lp, rp := strings.Index(stat, "("), strings.LastIndex(stat, ")")
+	if lp < 0 || rp < lp {
+		return processInfo{}, 0, false
+	}
+	fields := strings.Fields(stat[rp+1:])
+	if len(fields) < 3 {
+		return processInfo{}, 0, false
+	}
+
+	pid, err1 := strconv.Atoi(strings.TrimSpace(stat[:lp]))
+	ppid, err2 := strconv.Atoi(fields[1])
+	pgrp, err3 := strconv.Atoi(fields[2])
+	if err1 != nil || err2 != nil || err3 != nil {
+		return processInfo{}, 0, false
+	}
+	return processInfo{
+		pid:     pid,
+		ppid:    ppid,
+		state:   fields[0],
+		command: stat[lp+1 : rp],
+	}, pgrp, true
+}
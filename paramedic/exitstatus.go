@@ -24,3 +24,12 @@ func exitStatusFromError(err error) (int, error) {
 	}
 	return errorExitStatus, err
 }
+
+func signalFromError(err error) (syscall.Signal, bool) {
+	if eErr, ok := err.(*exec.ExitError); ok {
+		if s, ok := eErr.Sys().(syscall.WaitStatus); ok && s.Signaled() {
+			return s.Signal(), true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,211 @@
+package paramedic
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/firehose"
+)
+
+const (
+	firehoseMaxBatchRecords = 500
+	firehoseMaxBatchSize    = 4 * 1024 * 1024
+	firehoseMaxRecordSize   = 1000 * 1024
+	// a batch is dropped after this many attempts so that an unreachable
+	// stream does not keep the agent from exiting
+	firehoseMaxAttempts   = 5
+	firehoseMaxRetrySleep = 30 * time.Second
+)
+
+type firehoseRecord struct {
+	InstanceID string `json:"instanceId"`
+	RunID      string `json:"runId"`
+	Stream     string `json:"stream"`
+	Timestamp  int64  `json:"timestamp"` // milliseconds since epoch
+	Message    string `json:"message"`
+}
+
+type FirehoseWriter struct {
+	client     Firehose
+	stream     string
+	instanceID string
+	runID      string
+	interval   time.Duration
+	buffer     [][]byte
+	mutex      sync.Mutex
+	closed     bool
+
+	closeCh    chan struct{}
+	doneCh     chan struct{}
+	retrySleep time.Duration
+}
+
+func NewFirehoseWriter(client Firehose, stream string, instanceID string, runID string, interval time.Duration) *FirehoseWriter {
+	return &FirehoseWriter{
+		client:     client,
+		stream:     stream,
+		instanceID: instanceID,
+		runID:      runID,
+		interval:   interval,
+		buffer:     [][]byte{},
+		mutex:      sync.Mutex{},
+		closed:     false,
+
+		closeCh:    make(chan struct{}),
+		doneCh:     make(chan struct{}),
+		retrySleep: time.Second,
+	}
+}
+
+func (w *FirehoseWriter) Start() {
+	go func() {
+		closed := false
+		for {
+			select {
+			case <-w.closeCh:
+				closed = true
+			case <-time.After(w.interval):
+			}
+			w.flushBuffer()
+			if closed {
+				w.doneCh <- struct{}{}
+				break
+			}
+		}
+	}()
+}
+
+func (w *FirehoseWriter) Close() error {
+	log.Println("[DEBUG] Closing FirehoseWriter")
+	w.mutex.Lock()
+	w.closed = true
+	w.mutex.Unlock()
+
+	w.closeCh <- struct{}{}
+	<-w.doneCh
+	return nil
+}
+
+func (w *FirehoseWriter) writeEntries(entries []logEntry) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.closed {
+		return
+	}
+
+	for _, e := range entries {
+		r := firehoseRecord{
+			InstanceID: w.instanceID,
+			RunID:      w.runID,
+			Stream:     e.stream,
+			Timestamp:  e.timestamp.UnixNano() / 1000 / 1000,
+			Message:    e.text,
+		}
+		b, err := json.Marshal(r)
+		if err != nil {
+			log.Printf("[WARN] Failed to encode a firehose record: %s", err)
+			continue
+		}
+		b = append(b, '\n')
+		if len(b) > firehoseMaxRecordSize {
+			log.Printf("[WARN] Dropping a firehose record because it is larger than %d bytes", firehoseMaxRecordSize)
+			continue
+		}
+		w.buffer = append(w.buffer, b)
+	}
+}
+
+func (w *FirehoseWriter) flushBuffer() {
+	log.Println("[DEBUG] Flushing firehose buffer")
+	for {
+		remaining := w.flushBufferOnce()
+		if remaining == 0 {
+			break
+		}
+	}
+}
+
+func (w *FirehoseWriter) flushBufferOnce() int {
+	w.mutex.Lock()
+	batch := [][]byte{}
+	batchSize := 0
+	for _, r := range w.buffer {
+		if batchSize+len(r) > firehoseMaxBatchSize {
+			break
+		}
+		if len(batch) >= firehoseMaxBatchRecords {
+			break
+		}
+		batch = append(batch, r)
+		batchSize += len(r)
+	}
+	w.buffer = w.buffer[len(batch):]
+	remaining := len(w.buffer)
+	w.mutex.Unlock()
+
+	sleep := w.retrySleep
+	for attempt := 1; len(batch) > 0; attempt++ {
+		failed, err := w.putRecords(batch)
+		if err == nil && len(failed) == 0 {
+			break
+		}
+
+		if err != nil {
+			log.Printf("[WARN] Uploading firehose records failed: %s", err)
+		} else {
+			log.Printf("[WARN] %d of %d firehose records failed", len(failed), len(batch))
+			batch = failed
+		}
+		if attempt >= firehoseMaxAttempts {
+			log.Printf("[WARN] Dropping %d firehose records after %d attempts", len(batch), attempt)
+			break
+		}
+		log.Printf("[WARN] will retry after %s", sleep.String())
+		time.Sleep(sleep)
+		sleep *= 2
+		if sleep > firehoseMaxRetrySleep {
+			sleep = firehoseMaxRetrySleep
+		}
+	}
+
+	return remaining
+}
+
+// putRecords returns records which failed to be put.
+func (w *FirehoseWriter) putRecords(batch [][]byte) ([][]byte, error) {
+	log.Printf("[DEBUG] Uploading %d firehose records", len(batch))
+
+	records := []*firehose.Record{}
+	for _, b := range batch {
+		records = append(records, &firehose.Record{Data: b})
+	}
+
+	input := &firehose.PutRecordBatchInput{
+		DeliveryStreamName: aws.String(w.stream),
+		Records:            records,
+	}
+	output, err := w.client.PutRecordBatch(input)
+	if err != nil {
+		return nil, err
+	}
+
+	if aws.Int64Value(output.FailedPutCount) == 0 {
+		return nil, nil
+	}
+	if len(output.RequestResponses) != len(batch) {
+		return nil, fmt.Errorf("firehose returned %d responses for %d records", len(output.RequestResponses), len(batch))
+	}
+
+	failed := [][]byte{}
+	for i, r := range output.RequestResponses {
+		if r.ErrorCode != nil {
+			failed = append(failed, batch[i])
+		}
+	}
+	return failed, nil
+}
@@ -0,0 +1,116 @@
+package paramedic
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/firehose"
+	"github.com/golang/mock/gomock"
+	"github.com/ryotarai/paramedic-agent/mock"
+)
+
+// fakeFirehose fails the first record of the first request to exercise partial-failure retries.
+type fakeFirehose struct {
+	requests int
+	records  []firehoseRecord
+}
+
+func (f *fakeFirehose) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	var body struct {
+		DeliveryStreamName string
+		Records            []struct{ Data string }
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.requests++
+
+	failed := 0
+	responses := []map[string]string{}
+	for i, r := range body.Records {
+		if f.requests == 1 && i == 0 {
+			failed++
+			responses = append(responses, map[string]string{"ErrorCode": "ServiceUnavailableException", "ErrorMessage": "slow down"})
+			continue
+		}
+		b, _ := base64.StdEncoding.DecodeString(r.Data)
+		rec := firehoseRecord{}
+		json.Unmarshal(b, &rec)
+		f.records = append(f.records, rec)
+		responses = append(responses, map[string]string{"RecordId": fmt.Sprintf("%d-%d", f.requests, i)})
+	}
+
+	rw.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	json.NewEncoder(rw).Encode(map[string]interface{}{
+		"FailedPutCount":   failed,
+		"RequestResponses": responses,
+	})
+}
+
+func TestFirehoseWriter_PartialFailure(t *testing.T) {
+	fake := &fakeFirehose{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region:      aws.String("us-east-1"),
+		Endpoint:    aws.String(server.URL),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+	}))
+	w := NewFirehoseWriter(firehose.New(sess), "s", "i-123", "run-1", time.Hour)
+
+	w.writeEntries([]logEntry{
+		{text: "abc", timestamp: time.Now(), stream: streamStdout},
+		{text: "def", timestamp: time.Now(), stream: streamStderr},
+	})
+	w.flushBuffer()
+
+	if fake.requests != 2 {
+		t.Errorf("got %d requests but expected %d", fake.requests, 2)
+	}
+	if len(fake.records) != 2 {
+		t.Fatalf("got %d records but expected %d", len(fake.records), 2)
+	}
+	if fake.records[0].Message != "def" || fake.records[1].Message != "abc" {
+		t.Errorf("unexpected records: %+v", fake.records)
+	}
+	if fake.records[0].Stream != streamStderr {
+		t.Errorf("got stream %s but expected %s", fake.records[0].Stream, streamStderr)
+	}
+	if fake.records[0].InstanceID != "i-123" || fake.records[0].RunID != "run-1" {
+		t.Errorf("unexpected metadata: %+v", fake.records[0])
+	}
+}
+
+func TestFirehoseWriter_DropsAfterMaxAttempts(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	fm := mock.NewMockFirehose(mockCtrl)
+	fm.EXPECT().PutRecordBatch(gomock.Any()).Return(nil, errors.New("unreachable")).Times(firehoseMaxAttempts)
+
+	w := NewFirehoseWriter(fm, "s", "i-123", "run-1", time.Hour)
+	w.retrySleep = time.Millisecond
+	w.writeEntries([]logEntry{{text: "abc", timestamp: time.Now(), stream: streamStdout}})
+
+	done := make(chan struct{})
+	go func() {
+		w.flushBuffer()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("flushBuffer keeps retrying")
+	}
+}
@@ -0,0 +1,22 @@
+package paramedic
+
+import (
+	"fmt"
+	"strings"
+)
+
+// envFlag collects repeated "-env NAME=VALUE" flags.
+type envFlag map[string]string
+
+func (f envFlag) String() string {
+	return strings.Join(envList(f), ",")
+}
+
+func (f envFlag) Set(v string) error {
+	kv := strings.SplitN(v, "=", 2)
+	if len(kv) != 2 || kv[0] == "" {
+		return fmt.Errorf("invalid environment variable (must be NAME=VALUE): %s", v)
+	}
+	f[kv[0]] = kv[1]
+	return nil
+}
@@ -0,0 +1,289 @@
+package paramedic
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// jobRunner runs the script, or the steps of the job manifest, sharing the
+// output, environment and signals among them.
+type jobRunner struct {
+	clients    *awsClients
+	output     *Output
+	stepLogs   *stepLogWriter // nil if lines are not sent to CloudWatch Logs
+	out        io.Writer      // lines written by the agent
+	stdout     io.Writer
+	stderr     io.Writer
+	signalCh   <-chan *signal
+	status     *StatusReporter
+	acker      *SignalAcker
+	criteria   *criteriaEvaluator
+	inheritEnv string
+	env        []string
+	shutdown   *shutdownFlag // set when the agent is asked to terminate
+}
+
+// scriptRun is the outcome of a script including all attempts.
+type scriptRun struct {
+	exitStatus int
+	exitErr    error
+	version    string
+	last       *attempt
+	attempts   []attemptResult
+}
+
+// runScript downloads a script and runs it until it succeeds or retry gives up.
+// An error is returned only if the agent fails to run the script.
+func (r *jobRunner) runScript(bucket string, key string, timeout time.Duration, retry RetryPolicy, resetCriteria bool) (*scriptRun, error) {
+	if r.shutdown.isSet() {
+		return nil, errAgentShuttingDown
+	}
+
+	cmd := NewCommand(r.clients.s3, bucket, key, r.stdout, r.stderr)
+	switch r.inheritEnv {
+	case "all":
+	case "none":
+		cmd.SetInheritEnv(nil)
+	default:
+		cmd.SetInheritEnv(strings.Split(r.inheritEnv, ","))
+	}
+	cmd.AddEnv(r.env...)
+
+	if err := cmd.Download(); err != nil {
+		return nil, err
+	}
+	defer cmd.Cleanup()
+	r.status.Update(phaseDownloaded, nil)
+
+	run := &scriptRun{
+		version: cmd.ScriptVersion(),
+	}
+	results := []string{}
+
+	for attempt := 1; ; attempt++ {
+		if retry.enabled() {
+			fmt.Fprintf(r.out, "[attempt %d/%d]\n", attempt, retry.MaxAttempts)
+		}
+		if resetCriteria && r.criteria != nil {
+			r.criteria.reset()
+		}
+
+		a, err := r.attempt(cmd, timeout)
+		if err != nil {
+			return nil, err
+		}
+		// an unterminated last line belongs to this attempt, for criteria too
+		r.flushOutput()
+		run.last = a
+		run.exitStatus, run.exitErr = exitStatusFromError(a.err)
+		if retry.enabled() {
+			run.attempts = append(run.attempts, a.attemptResult)
+		}
+		if run.exitErr == nil {
+			results = append(results, fmt.Sprintf("%d", run.exitStatus))
+		} else {
+			results = append(results, run.exitErr.Error())
+		}
+
+		// criteria of steps are evaluated for the whole job, not for each attempt
+		var criteria *criteriaEvaluator
+		if resetCriteria {
+			criteria = r.criteria
+		}
+		if !retry.retryable(attempt, run.exitStatus, run.exitErr, criteria) {
+			break
+		}
+		if r.shutdown.isSet() {
+			fmt.Fprintf(r.out, "[retry cancelled: %s]\n", errAgentShuttingDown)
+			break
+		}
+
+		wait := retry.backoff(attempt)
+		log.Printf("[INFO] Retrying the command in %s", wait)
+		fmt.Fprintf(r.out, "[attempt %d failed with exit status %d, retrying in %s]\n", attempt, run.exitStatus, wait)
+		if sig := r.waitOrSignal(wait); sig != nil {
+			log.Printf("[INFO] Giving up retries because a signal is received: %s", sig)
+			fmt.Fprintf(r.out, "[retry cancelled by %s]\n", sig)
+			break
+		}
+	}
+	if retry.enabled() {
+		fmt.Fprintf(r.out, "[attempts: %d (%s)]\n", len(results), strings.Join(results, ", "))
+	}
+
+	return run, nil
+}
+
+type attempt struct {
+	attemptResult
+	err error // error returned by Wait
+}
+
+// attempt runs cmd once and waits for it to exit, relaying signals and enforcing timeout.
+func (r *jobRunner) attempt(cmd *Command, timeout time.Duration) (*attempt, error) {
+	a := &attempt{}
+	a.StartedAt = time.Now()
+
+	cmdCh, err := cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+	r.status.Update(phaseRunning, func(s *instanceStatus) {
+		s.PID = cmd.Pid()
+	})
+
+	var deadline time.Time
+	var timeoutCh <-chan time.Time
+	if timeout > 0 {
+		deadline = a.StartedAt.Add(timeout)
+		timeoutCh = time.After(timeout)
+	}
+	var escalateCh <-chan time.Time
+	var escalating *signal
+
+	for {
+		select {
+		case err := <-cmdCh:
+			// command exited
+			a.FinishedAt = time.Now()
+			a.err = err
+			exitStatus, exitErr := exitStatusFromError(err)
+			if exitErr == nil {
+				log.Printf("[INFO] The command exited with status %d", exitStatus)
+				a.ExitStatus = aws.Int(exitStatus)
+			}
+			if s, ok := signalFromError(err); ok {
+				a.Signal = aws.Int(int(s))
+			}
+			r.status.Update(phaseExited, func(s *instanceStatus) {
+				s.ExitStatus = a.ExitStatus
+			})
+			return a, nil
+		case signal := <-r.signalCh:
+			if signal.invalid != nil {
+				log.Printf("[WARN] Ignoring an invalid signal object: %s", signal.invalid)
+				fmt.Fprintf(r.out, "[signal ignored: %s]\n", signal.invalid)
+				r.acker.Ignore(signal, signal.invalid.Error())
+				continue
+			}
+			r.status.Update(phaseSignalReceived, func(s *instanceStatus) {
+				s.Signal = int(signal.number)
+				s.Action = signal.Action
+			})
+
+			switch signal.Action {
+			case signalActionSignal:
+				r.sendSignal(cmd, signal, signal.number, signal.group)
+			case signalActionKillTree, signalActionPause, signalActionResume:
+				r.sendSignal(cmd, signal, signal.number, true)
+			case signalActionEscalate:
+				r.sendSignal(cmd, signal, signal.number, signal.group)
+				fmt.Fprintf(r.out, "[escalating to SIGKILL in %s]\n", signal.duration)
+				escalateCh = time.After(signal.duration)
+				escalating = signal
+			case signalActionExtendTimeout:
+				if deadline.IsZero() {
+					fmt.Fprintf(r.out, "[signal ignored: no timeout to extend]\n")
+					r.acker.Ignore(signal, "no timeout to extend")
+					continue
+				}
+				deadline = deadline.Add(signal.duration)
+				timeout += signal.duration
+				timeoutCh = time.After(deadline.Sub(time.Now()))
+				fmt.Fprintf(r.out, "[timeout extended to %s]\n", timeout)
+				r.acker.Ack(signal, 0, []int{cmd.Pid()}, nil)
+			case signalActionDumpDiagnostics:
+				r.dumpDiagnostics(cmd, a, deadline)
+				r.acker.Ack(signal, 0, []int{cmd.Pid()}, nil)
+			}
+		case <-timeoutCh:
+			log.Printf("[INFO] The command timed out after %s", timeout)
+			fmt.Fprintf(r.out, "[timed out after %s]\n", timeout)
+			a.TimedOut = true
+			cmd.SignalGroup(syscall.SIGKILL)
+		case <-escalateCh:
+			log.Printf("[INFO] Escalating to SIGKILL")
+			fmt.Fprintf(r.out, "[escalated to SIGKILL]\n")
+			r.sendSignal(cmd, escalating, syscall.SIGKILL, true)
+		}
+	}
+}
+
+// flushOutput sends the incomplete trailing lines of the script's output.
+func (r *jobRunner) flushOutput() {
+	if r.output == nil {
+		return
+	}
+	r.output.FlushStream(r.stdout)
+	r.output.FlushStream(r.stderr)
+}
+
+// sendSignal sends sig to the script, or to its process group, on behalf of
+// signal s from the watcher and acknowledges it.
+func (r *jobRunner) sendSignal(cmd *Command, s *signal, sig syscall.Signal, group bool) {
+	pids := []int{cmd.Pid()}
+	var err error
+	if group {
+		if procs, perr := processGroup(cmd.Pid()); perr == nil && len(procs) > 0 {
+			pids = []int{}
+			for _, p := range procs {
+				pids = append(pids, p.pid)
+			}
+		}
+		err = cmd.SignalGroup(sig)
+	} else {
+		err = cmd.Signal(sig)
+	}
+	if err != nil {
+		log.Printf("[WARN] Failed to send signal %d: %s", sig, err)
+	}
+	r.acker.Ack(s, int(sig), pids, err)
+}
+
+// dumpDiagnostics writes the state of the running attempt to the output.
+func (r *jobRunner) dumpDiagnostics(cmd *Command, a *attempt, deadline time.Time) {
+	fmt.Fprintf(r.out, "[diagnostics: pid %d, running for %s]\n", cmd.Pid(), time.Now().Sub(a.StartedAt))
+	if !deadline.IsZero() {
+		fmt.Fprintf(r.out, "[diagnostics: timeout in %s]\n", deadline.Sub(time.Now()))
+	}
+
+	procs, err := processGroup(cmd.Pid())
+	if err != nil {
+		fmt.Fprintf(r.out, "[diagnostics: process tree unavailable: %s]\n", err)
+		return
+	}
+	for _, p := range procs {
+		fmt.Fprintf(r.out, "[diagnostics: pid %d ppid %d state %s %s]\n", p.pid, p.ppid, p.state, p.command)
+	}
+}
+
+// waitOrSignal waits for d and returns a signal stopping the script if one
+// is received meanwhile. Other signals are ignored since no script is running.
+func (r *jobRunner) waitOrSignal(d time.Duration) *signal {
+	timeoutCh := time.After(d)
+	for {
+		select {
+		case <-timeoutCh:
+			return nil
+		case s := <-r.signalCh:
+			switch {
+			case s.invalid != nil:
+				fmt.Fprintf(r.out, "[signal ignored: %s]\n", s.invalid)
+				r.acker.Ignore(s, s.invalid.Error())
+			case s.terminates():
+				// no script is running; the signal cancels the retries
+				r.acker.Ack(s, int(s.number), nil, nil)
+				return s
+			default:
+				fmt.Fprintf(r.out, "[signal ignored while waiting for retry: %s]\n", s)
+				r.acker.Ignore(s, "no script is running")
+			}
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package paramedic
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"time"
+)
+
+const defaultJournaldSocket = "/run/systemd/journal/socket"
+
+// journaldLogger speaks the native journal protocol.
+// See https://systemd.io/JOURNAL_NATIVE_PROTOCOL/
+type journaldLogger struct {
+	conn   *net.UnixConn
+	fields localLogFields
+}
+
+func newJournaldLogger(address string, fields localLogFields) (*journaldLogger, error) {
+	if address == "" {
+		address = defaultJournaldSocket
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: address, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+
+	return &journaldLogger{
+		conn:   conn,
+		fields: fields,
+	}, nil
+}
+
+func (l *journaldLogger) send(e logEntry) error {
+	buf := &bytes.Buffer{}
+	writeJournalField(buf, "MESSAGE", e.text)
+	writeJournalField(buf, "PRIORITY", "6")
+	writeJournalField(buf, "SYSLOG_IDENTIFIER", "paramedic-agent")
+	writeJournalField(buf, "PARAMEDIC_RUN_ID", l.fields.RunID)
+	writeJournalField(buf, "PARAMEDIC_INSTANCE_ID", l.fields.InstanceID)
+	writeJournalField(buf, "PARAMEDIC_LOG_STREAM", l.fields.LogStream)
+	writeJournalField(buf, "PARAMEDIC_OUTPUT_STREAM", e.stream)
+
+	l.conn.SetWriteDeadline(time.Now().Add(localLogWriteTimeout))
+	_, err := l.conn.Write(buf.Bytes())
+	return err
+}
+
+func (l *journaldLogger) Close() error {
+	return l.conn.Close()
+}
+
+func writeJournalField(buf *bytes.Buffer, name string, value string) {
+	if !strings.Contains(value, "\n") {
+		buf.WriteString(name)
+		buf.WriteByte('=')
+		buf.WriteString(value)
+		buf.WriteByte('\n')
+		return
+	}
+
+	// values containing newlines are length-prefixed
+	buf.WriteString(name)
+	buf.WriteByte('\n')
+	binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+}
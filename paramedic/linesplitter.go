@@ -0,0 +1,42 @@
+package paramedic
+
+import (
+	"strings"
+	"time"
+)
+
+// lineSplitter splits written chunks into log entries, keeping an incomplete
+// trailing line until the next chunk or flush.
+type lineSplitter struct {
+	partialStr string
+}
+
+func (s *lineSplitter) split(p []byte) []logEntry {
+	text := s.partialStr + string(p)
+	lines := strings.Split(text, "\n")
+	s.partialStr = lines[len(lines)-1]
+	lines = lines[:len(lines)-1]
+
+	entries := []logEntry{}
+	for _, l := range lines {
+		e := logEntry{
+			text:      l,
+			timestamp: time.Now(),
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func (s *lineSplitter) flush() []logEntry {
+	if len(s.partialStr) == 0 {
+		return nil
+	}
+
+	e := logEntry{
+		text:      s.partialStr,
+		timestamp: time.Now(),
+	}
+	s.partialStr = ""
+	return []logEntry{e}
+}
@@ -0,0 +1,149 @@
+package paramedic
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// lines waiting to be sent to the local log; more lines are dropped
+	localLogMaxPending = 10000
+	// how long a single line may take to be sent to the local log
+	localLogWriteTimeout = time.Second
+)
+
+// localLogger sends a single log entry to a local logging daemon.
+type localLogger interface {
+	send(e logEntry) error
+	Close() error
+}
+
+// localLogFields are attached to every entry as structured data.
+type localLogFields struct {
+	RunID      string
+	InstanceID string
+	LogStream  string
+}
+
+// LocalLogWriter forwards each output line to journald or syslog on the host
+// so that the output survives even if CloudWatch Logs is unreachable.
+// Lines are sent in the background so that a stalled daemon does not block
+// the other outputs or the command.
+type LocalLogWriter struct {
+	logger   localLogger
+	pending  []logEntry
+	mutex    sync.Mutex
+	started  bool
+	failures int // only touched by the sending goroutine
+	dropped  int
+
+	updateCh chan struct{}
+	closeCh  chan struct{}
+	doneCh   chan struct{}
+}
+
+func NewLocalLogWriter(kind string, address string, fields localLogFields) (*LocalLogWriter, error) {
+	var logger localLogger
+	var err error
+	switch kind {
+	case "journald":
+		logger, err = newJournaldLogger(address, fields)
+	case "syslog":
+		logger, err = newSyslogLogger(address, fields)
+	default:
+		return nil, fmt.Errorf("unknown local log: %s", kind)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &LocalLogWriter{
+		logger: logger,
+		mutex:  sync.Mutex{},
+
+		updateCh: make(chan struct{}, 1),
+		closeCh:  make(chan struct{}),
+		doneCh:   make(chan struct{}),
+	}, nil
+}
+
+func (w *LocalLogWriter) Start() {
+	w.started = true
+
+	go func() {
+		defer close(w.doneCh)
+		for {
+			select {
+			case <-w.updateCh:
+				w.send()
+			case <-w.closeCh:
+				w.send()
+				return
+			}
+		}
+	}()
+}
+
+func (w *LocalLogWriter) writeEntries(entries []logEntry) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.enqueue(entries)
+}
+
+func (w *LocalLogWriter) Close() error {
+	if w.started {
+		close(w.closeCh)
+		<-w.doneCh
+	} else {
+		w.send()
+	}
+
+	if w.failures > 0 {
+		log.Printf("[WARN] %d lines could not be sent to the local log", w.failures)
+	}
+	if w.dropped > 0 {
+		log.Printf("[WARN] %d lines were dropped because the local log did not keep up", w.dropped)
+	}
+	return w.logger.Close()
+}
+
+// enqueue drops lines beyond localLogMaxPending. It must be called with the mutex held.
+func (w *LocalLogWriter) enqueue(entries []logEntry) {
+	for _, e := range entries {
+		if len(w.pending) >= localLogMaxPending {
+			if w.dropped == 0 {
+				log.Println("[WARN] Dropping lines because the local log does not keep up")
+			}
+			w.dropped++
+			continue
+		}
+		w.pending = append(w.pending, e)
+	}
+
+	select {
+	case w.updateCh <- struct{}{}:
+	default: // a send is already pending
+	}
+}
+
+// send drops lines which cannot be sent. Once a line fails, the rest of the
+// batch is dropped too so that a stalled daemon costs a single write timeout.
+func (w *LocalLogWriter) send() {
+	w.mutex.Lock()
+	entries := w.pending
+	w.pending = nil
+	w.mutex.Unlock()
+
+	for i, e := range entries {
+		if err := w.logger.send(e); err != nil {
+			if w.failures == 0 {
+				log.Printf("[WARN] Sending a line to the local log failed: %s", err)
+			}
+			w.failures += len(entries) - i
+			return
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package paramedic
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestWriteJournalField(t *testing.T) {
+	buf := &bytes.Buffer{}
+	writeJournalField(buf, "MESSAGE", "hello")
+	if buf.String() != "MESSAGE=hello\n" {
+		t.Errorf("got %q", buf.String())
+	}
+
+	buf.Reset()
+	writeJournalField(buf, "MESSAGE", "a\nb")
+	expected := &bytes.Buffer{}
+	expected.WriteString("MESSAGE\n")
+	binary.Write(expected, binary.LittleEndian, uint64(3))
+	expected.WriteString("a\nb\n")
+	if !bytes.Equal(buf.Bytes(), expected.Bytes()) {
+		t.Errorf("got %q but expected %q", buf.Bytes(), expected.Bytes())
+	}
+}
+
+func TestEscapeSDParam(t *testing.T) {
+	cases := map[string]string{
+		"i-123":       "i-123",
+		`say "hi"`:    `say \"hi\"`,
+		`a\b`:         `a\\b`,
+		"[x]":         `[x\]`,
+		`"\]` + "end": `\"\\\]end`,
+	}
+	for in, expected := range cases {
+		if got := escapeSDParam(in); got != expected {
+			t.Errorf("escapeSDParam(%q) = %q but expected %q", in, got, expected)
+		}
+	}
+}
+
+var testLocalLogFields = localLogFields{
+	RunID:      "run-1",
+	InstanceID: "i-123",
+	LogStream:  "paramedic/i-123",
+}
+
+func TestLocalLogWriter_Journald(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journald")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "socket")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	w, err := NewLocalLogWriter("journald", path, testLocalLogFields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Start()
+	w.writeEntries([]logEntry{{text: "hello", stream: streamStderr, timestamp: time.Now()}})
+	w.Close()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 4096)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := string(buf[:n])
+	for _, field := range []string{"MESSAGE=hello\n", "SYSLOG_IDENTIFIER=paramedic-agent\n", "PARAMEDIC_RUN_ID=run-1\n", "PARAMEDIC_INSTANCE_ID=i-123\n", "PARAMEDIC_OUTPUT_STREAM=stderr\n"} {
+		if !bytes.Contains(buf[:n], []byte(field)) {
+			t.Errorf("%q is not in %q", field, got)
+		}
+	}
+}
+
+func TestLocalLogWriter_Syslog(t *testing.T) {
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+
+	fields := testLocalLogFields
+	fields.LogStream = `stream "quoted"`
+	w, err := NewLocalLogWriter("syslog", "udp://"+udp.LocalAddr().String(), fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := time.Date(2017, 9, 1, 12, 0, 0, 0, time.UTC)
+	w.writeEntries([]logEntry{{text: "hello", stream: streamStdout, timestamp: ts}})
+	w.Close()
+
+	udp.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 4096)
+	n, _, err := udp.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	re := regexp.MustCompile(`^<14>1 2017-09-01T12:00:00Z \S+ paramedic-agent \d+ - \[paramedic@32473 runId="run-1" instanceId="i-123" logStream="stream \\"quoted\\"" stream="stdout"\] hello$`)
+	if !re.Match(buf[:n]) {
+		t.Errorf("got %q", buf[:n])
+	}
+}
+
+func TestLocalLogWriter_SyslogOctetCounting(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		b, _ := ioutil.ReadAll(conn)
+		received <- b
+	}()
+
+	w, err := NewLocalLogWriter("syslog", "tcp://"+l.Addr().String(), testLocalLogFields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.writeEntries([]logEntry{{text: "one", timestamp: time.Now()}, {text: "two", timestamp: time.Now()}})
+	w.Close()
+
+	select {
+	case b := <-received:
+		re := regexp.MustCompile(`^(\d+) (<14>1 [^\n]*? one)(\d+) (<14>1 [^\n]*? two)$`)
+		m := re.FindSubmatch(b)
+		if m == nil {
+			t.Fatalf("got %q", b)
+		}
+		if string(m[1]) != strconv.Itoa(len(m[2])) || string(m[3]) != strconv.Itoa(len(m[4])) {
+			t.Errorf("wrong frame lengths in %q", b)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing is received")
+	}
+}
+
+// stalledLogger blocks every send until release is closed.
+type stalledLogger struct {
+	sending chan struct{}
+	release chan struct{}
+	sent    int
+}
+
+func (l *stalledLogger) send(e logEntry) error {
+	select {
+	case l.sending <- struct{}{}:
+	default:
+	}
+	<-l.release
+	l.sent++
+	return nil
+}
+
+func (l *stalledLogger) Close() error {
+	return nil
+}
+
+func TestLocalLogWriter_StalledLogger(t *testing.T) {
+	logger := &stalledLogger{sending: make(chan struct{}, 1), release: make(chan struct{})}
+	w := &LocalLogWriter{
+		logger:   logger,
+		updateCh: make(chan struct{}, 1),
+		closeCh:  make(chan struct{}),
+		doneCh:   make(chan struct{}),
+	}
+	w.Start()
+
+	// the first line stalls the logger
+	w.writeEntries([]logEntry{{text: "first", timestamp: time.Now()}})
+	select {
+	case <-logger.sending:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the first line is not sent")
+	}
+
+	written := make(chan struct{})
+	go func() {
+		for i := 0; i < localLogMaxPending+10; i++ {
+			w.writeEntries([]logEntry{{text: "line", timestamp: time.Now()}})
+		}
+		close(written)
+	}()
+	select {
+	case <-written:
+	case <-time.After(5 * time.Second):
+		t.Fatal("writeEntries is blocked by the stalled logger")
+	}
+
+	close(logger.release)
+	w.Close()
+
+	if logger.sent != localLogMaxPending+1 || w.dropped != 10 {
+		t.Errorf("%d lines are sent and %d are dropped", logger.sent, w.dropped)
+	}
+}
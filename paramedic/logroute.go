@@ -0,0 +1,108 @@
+package paramedic
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+// LogRoute sends lines matching Pattern to an additional log stream.
+// Empty LogGroup or LogStream means the main one. LogStream is suffixed with
+// the instance ID so that instances do not write to the same stream.
+type LogRoute struct {
+	Pattern   string `yaml:"Pattern"`
+	LogGroup  string `yaml:"LogGroup"`
+	LogStream string `yaml:"LogStream"`
+}
+
+func (r LogRoute) validate() error {
+	if r.Pattern == "" {
+		return errors.New("Pattern of a log route is mandatory")
+	}
+	if r.LogGroup == "" && r.LogStream == "" {
+		return errors.New("a log route needs LogGroup or LogStream")
+	}
+	if _, err := regexp.Compile(r.Pattern); err != nil {
+		return fmt.Errorf("invalid pattern of a log route: %s", err)
+	}
+	return nil
+}
+
+type logDestination struct {
+	patterns []*regexp.Regexp
+	writer   *CloudWatchLogsWriter
+}
+
+// LogRouter copies matching lines to additional log streams.
+// The full output still goes to the main writer.
+type LogRouter struct {
+	destinations []*logDestination
+}
+
+// NewLogRouter starts a writer for each distinct destination of routes,
+// sharing the client and settings of the main writer.
+func NewLogRouter(routes []LogRoute, main *CloudWatchLogsWriter, instanceID string) (*LogRouter, error) {
+	router := &LogRouter{
+		destinations: []*logDestination{},
+	}
+	destinations := map[string]*logDestination{}
+
+	for _, r := range routes {
+		if err := r.validate(); err != nil {
+			router.Close()
+			return nil, err
+		}
+
+		group, stream := r.LogGroup, main.stream
+		if group == "" {
+			group = main.group
+		}
+		if r.LogStream != "" {
+			stream = r.LogStream + "/" + instanceID
+		}
+		if group == main.group && stream == main.stream {
+			router.Close()
+			return nil, fmt.Errorf("a log route for %s points to the main log stream", r.Pattern)
+		}
+
+		key := group + ":" + stream
+		d, ok := destinations[key]
+		if !ok {
+			w := main.derive(group, stream)
+			if err := w.Start(); err != nil {
+				router.Close()
+				return nil, err
+			}
+			d = &logDestination{writer: w}
+			destinations[key] = d
+			router.destinations = append(router.destinations, d)
+		}
+		d.patterns = append(d.patterns, regexp.MustCompile(r.Pattern))
+	}
+
+	return router, nil
+}
+
+func (r *LogRouter) writeEntries(entries []logEntry) {
+	for _, d := range r.destinations {
+		matched := []logEntry{}
+		for _, e := range entries {
+			for _, p := range d.patterns {
+				if p.MatchString(e.text) {
+					matched = append(matched, e)
+					break
+				}
+			}
+		}
+		if len(matched) > 0 {
+			d.writer.writeEntries(matched)
+		}
+	}
+}
+
+func (r *LogRouter) Close() error {
+	for _, d := range r.destinations {
+		d.writer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package paramedic
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/golang/mock/gomock"
+	"github.com/ryotarai/paramedic-agent/mock"
+)
+
+func TestNewLogRouter(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	cwlogs := mock.NewMockCloudWatchLogs(mockCtrl)
+	main := NewCloudWatchLogsWriter(cwlogs, "g", "paramedic/i-123", time.Hour)
+
+	routes := []LogRoute{
+		{Pattern: "WARN", LogStream: "warnings"},
+		{Pattern: "ERROR", LogStream: "warnings"},
+		{Pattern: "FATAL", LogGroup: "fatal"},
+	}
+
+	// another run on the same instance left the stream
+	cwlogs.EXPECT().CreateLogStream(&cloudwatchlogs.CreateLogStreamInput{
+		LogGroupName:  aws.String("g"),
+		LogStreamName: aws.String("warnings/i-123"),
+	}).Return(nil, awserr.New(cloudwatchlogs.ErrCodeResourceAlreadyExistsException, "exists", nil))
+	cwlogs.EXPECT().DescribeLogStreams(gomock.Any()).Return(&cloudwatchlogs.DescribeLogStreamsOutput{
+		LogStreams: []*cloudwatchlogs.LogStream{
+			{LogStreamName: aws.String("warnings/i-1234"), UploadSequenceToken: aws.String("wrong")},
+			{LogStreamName: aws.String("warnings/i-123"), UploadSequenceToken: aws.String("t1")},
+		},
+	}, nil)
+	cwlogs.EXPECT().CreateLogStream(&cloudwatchlogs.CreateLogStreamInput{
+		LogGroupName:  aws.String("fatal"),
+		LogStreamName: aws.String("paramedic/i-123"),
+	}).Return(&cloudwatchlogs.CreateLogStreamOutput{}, nil)
+
+	router, err := NewLogRouter(routes, main, "i-123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer router.Close()
+	if len(router.destinations) != 2 {
+		t.Fatalf("got %d destinations but expected 2", len(router.destinations))
+	}
+
+	router.writeEntries([]logEntry{
+		{text: "WARN a", timestamp: time.Now()},
+		{text: "INFO b", timestamp: time.Now()},
+		{text: "ERROR c", timestamp: time.Now()},
+	})
+	cwlogs.EXPECT().PutLogEvents(gomock.Any()).Do(func(input *cloudwatchlogs.PutLogEventsInput) {
+		if aws.StringValue(input.LogStreamName) != "warnings/i-123" || aws.StringValue(input.SequenceToken) != "t1" {
+			t.Errorf("got %s (%s)", aws.StringValue(input.LogStreamName), aws.StringValue(input.SequenceToken))
+		}
+		if len(input.LogEvents) != 2 || *input.LogEvents[0].Message != "WARN a" || *input.LogEvents[1].Message != "ERROR c" {
+			t.Errorf("unexpected events: %v", input.LogEvents)
+		}
+	}).Return(&cloudwatchlogs.PutLogEventsOutput{NextSequenceToken: aws.String("t2")}, nil)
+	router.destinations[0].writer.flushBuffer()
+	router.destinations[1].writer.flushBuffer()
+}
+
+func TestNewLogRouter_Invalid(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	cwlogs := mock.NewMockCloudWatchLogs(mockCtrl)
+	main := NewCloudWatchLogsWriter(cwlogs, "g", "paramedic/i-123", time.Hour)
+
+	cases := [][]LogRoute{
+		{{Pattern: "", LogStream: "s"}},
+		{{Pattern: "("}},
+		{{Pattern: "(", LogStream: "s"}},
+		{{Pattern: "x", LogGroup: "g"}}, // the main stream
+	}
+	for _, routes := range cases {
+		if _, err := NewLogRouter(routes, main, "i-123"); err == nil {
+			t.Errorf("%+v should be invalid", routes)
+		}
+	}
+}
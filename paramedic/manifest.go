@@ -0,0 +1,59 @@
+package paramedic
+
+import (
+	"io/ioutil"
+	"log"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"gopkg.in/yaml.v2"
+)
+
+// Manifest describes a job in addition to the script.
+// It is an optional YAML object in S3 given by -manifest-s3-key.
+type Manifest struct {
+	LogRoutes []LogRoute `yaml:"LogRoutes"`
+	Redaction Redaction  `yaml:"Redaction"`
+
+	// Environment is passed to the script. A value in the form of
+	// "ssm:/path/name" is resolved with SSM Parameter Store.
+	Environment map[string]string `yaml:"Environment"`
+	// SecretsFile makes SSM parameters written to a file readable only by the
+	// owner instead of environment variables. Its path is in PARAMEDIC_SECRETS_FILE.
+	SecretsFile bool `yaml:"SecretsFile"`
+	// InheritEnv overrides -inherit-env if given.
+	InheritEnv string `yaml:"InheritEnv"`
+
+	SuccessCriteria SuccessCriteria `yaml:"SuccessCriteria"`
+	Retry           RetryPolicy     `yaml:"Retry"`
+
+	// Steps replaces the script given by -script-s3-key with an ordered list of scripts.
+	Steps []Step `yaml:"Steps"`
+}
+
+func LoadManifest(client S3, bucket string, key string) (*Manifest, error) {
+	log.Printf("[INFO] Downloading a manifest from s3://%s/%s", bucket, key)
+
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+	output, err := client.GetObject(input)
+	if err != nil {
+		return nil, err
+	}
+	defer output.Body.Close()
+
+	b, err := ioutil.ReadAll(output.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Manifest{}
+	err = yaml.Unmarshal(b, m)
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
@@ -0,0 +1,242 @@
+package paramedic
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	streamStdout = "stdout"
+	streamStderr = "stderr"
+	streamAgent  = "agent" // lines written by the agent itself, e.g. exit status
+)
+
+// entryWriter receives complete lines from Output.
+type entryWriter interface {
+	writeEntries(entries []logEntry)
+}
+
+// Output splits each output stream of a command into lines once, redacts
+// them, strips control lines and distributes them to entry writers and raw writers.
+type Output struct {
+	entryWriters []entryWriter
+	rawWriters   []io.Writer
+	redactor     *Redactor
+	control      *ControlChannel
+	startedAt    time.Time
+	streams      []*outputStream
+	counters     []*countingWriter // of the streams of the command
+	mutex        sync.Mutex
+
+	lineNumber int64
+}
+
+type outputStream struct {
+	output   *Output
+	name     string
+	step     string // name of the step in a parallel group
+	prefix   string // prepended to each line
+	splitter lineSplitter
+	redact   redactState
+}
+
+func NewOutput(redactor *Redactor) *Output {
+	return &Output{
+		entryWriters: []entryWriter{},
+		rawWriters:   []io.Writer{},
+		redactor:     redactor,
+		startedAt:    time.Now(),
+		streams:      []*outputStream{},
+		counters:     []*countingWriter{},
+		mutex:        sync.Mutex{},
+	}
+}
+
+// SetControlChannel makes control lines from the command handled by c instead of being output.
+func (o *Output) SetControlChannel(c *ControlChannel) {
+	o.control = c
+}
+
+func (o *Output) AddEntryWriter(w entryWriter) {
+	o.entryWriters = append(o.entryWriters, w)
+}
+
+func (o *Output) AddRawWriter(w io.Writer) {
+	o.rawWriters = append(o.rawWriters, w)
+}
+
+// Stream returns a writer whose lines are tagged with name.
+func (o *Output) Stream(name string) io.Writer {
+	s := &outputStream{
+		output: o,
+		name:   name,
+	}
+	return o.add(s)
+}
+
+// StepStream returns a writer whose lines are tagged with name and step. If
+// prefixed, each line is also prefixed with the step name so that lines of
+// steps running concurrently can be told apart in a shared log stream.
+func (o *Output) StepStream(name string, step string, prefixed bool) io.Writer {
+	s := &outputStream{
+		output: o,
+		name:   name,
+		step:   step,
+	}
+	if prefixed {
+		s.prefix = "[" + step + "] "
+	}
+	return o.add(s)
+}
+
+// add registers s and counts what the command writes to it.
+func (o *Output) add(s *outputStream) io.Writer {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	o.streams = append(o.streams, s)
+	if s.name == streamAgent {
+		return s
+	}
+	c := &countingWriter{writer: s}
+	o.counters = append(o.counters, c)
+	return c
+}
+
+// Flush sends incomplete trailing lines of all streams.
+func (o *Output) Flush() {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	for _, s := range o.streams {
+		o.flush(s)
+	}
+}
+
+// FlushStream sends the incomplete trailing line of a writer returned by
+// Stream or StepStream, e.g. when the command writing to it exits.
+func (o *Output) FlushStream(w io.Writer) {
+	if c, ok := w.(*countingWriter); ok {
+		w = c.writer
+	}
+	s, ok := w.(*outputStream)
+	if !ok {
+		return
+	}
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.flush(s)
+}
+
+func (o *Output) flush(s *outputStream) {
+	entries := s.splitter.flush()
+	o.redactEntries(s, entries)
+	entries = o.handleControl(s, entries)
+	s.label(entries)
+	for _, e := range entries {
+		// terminated so that the next line, e.g. of the agent, starts on its own line
+		o.writeRaw(e.text + "\n")
+	}
+	o.dispatch(s, entries)
+}
+
+// Bytes returns the number of bytes emitted by the command.
+func (o *Output) Bytes() int64 {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	n := int64(0)
+	for _, c := range o.counters {
+		n += c.Bytes()
+	}
+	return n
+}
+
+// Lines returns the number of lines emitted by the command.
+func (o *Output) Lines() int64 {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	n := int64(0)
+	for _, c := range o.counters {
+		n += c.Lines()
+	}
+	return n
+}
+
+func (s *outputStream) Write(p []byte) (int, error) {
+	o := s.output
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	entries := s.splitter.split(p)
+	o.redactEntries(s, entries)
+	entries = o.handleControl(s, entries)
+	s.label(entries)
+	for _, e := range entries {
+		o.writeRaw(e.text + "\n")
+	}
+	o.dispatch(s, entries)
+
+	return len(p), nil
+}
+
+func (s *outputStream) label(entries []logEntry) {
+	for i := range entries {
+		entries[i].text = s.prefix + entries[i].text
+		entries[i].step = s.step
+	}
+}
+
+// redactEntries must be called with the mutex held.
+func (o *Output) redactEntries(s *outputStream, entries []logEntry) {
+	if o.redactor == nil {
+		return
+	}
+	for i := range entries {
+		entries[i].text = o.redactor.redact(entries[i].text, &s.redact)
+	}
+}
+
+// handleControl must be called with the mutex held.
+func (o *Output) handleControl(s *outputStream, entries []logEntry) []logEntry {
+	if o.control == nil || s.name == streamAgent {
+		return entries
+	}
+
+	kept := entries[:0]
+	for _, e := range entries {
+		if !o.control.handle(e.text) {
+			kept = append(kept, e)
+		}
+	}
+	return kept
+}
+
+// writeRaw must be called with the mutex held.
+func (o *Output) writeRaw(text string) {
+	for _, w := range o.rawWriters {
+		w.Write([]byte(text))
+	}
+}
+
+// dispatch must be called with the mutex held.
+func (o *Output) dispatch(s *outputStream, entries []logEntry) {
+	if len(entries) == 0 {
+		return
+	}
+
+	for i := range entries {
+		if s.name != streamAgent {
+			o.lineNumber++
+			entries[i].line = o.lineNumber
+		}
+		entries[i].stream = s.name
+		entries[i].elapsed = entries[i].timestamp.Sub(o.startedAt)
+	}
+	for _, w := range o.entryWriters {
+		w.writeEntries(entries)
+	}
+}
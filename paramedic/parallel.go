@@ -0,0 +1,305 @@
+package paramedic
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// stepLogWriter sends lines of steps with their own log stream to
+// "<log stream>/<step name>" and the other lines to the main writer.
+type stepLogWriter struct {
+	main    *CloudWatchLogsWriter
+	writers map[string]*CloudWatchLogsWriter
+	mutex   sync.Mutex
+}
+
+func newStepLogWriter(main *CloudWatchLogsWriter) *stepLogWriter {
+	return &stepLogWriter{
+		main:    main,
+		writers: map[string]*CloudWatchLogsWriter{},
+		mutex:   sync.Mutex{},
+	}
+}
+
+// separate starts a writer to the log stream of step.
+func (w *stepLogWriter) separate(step string) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if _, ok := w.writers[step]; ok {
+		return nil
+	}
+	d := w.main.derive(w.main.group, w.main.stream+"/"+step)
+	if err := d.Start(); err != nil {
+		return err
+	}
+	w.writers[step] = d
+	return nil
+}
+
+func (w *stepLogWriter) writeEntries(entries []logEntry) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	main := []logEntry{}
+	for _, e := range entries {
+		if d, ok := w.writers[e.step]; ok && e.step != "" {
+			d.writeEntries([]logEntry{e})
+			continue
+		}
+		main = append(main, e)
+	}
+	if len(main) > 0 {
+		w.main.writeEntries(main)
+	}
+}
+
+// Close closes the writers of steps. The main writer is not closed.
+func (w *stepLogWriter) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	for _, d := range w.writers {
+		d.Close()
+	}
+	return nil
+}
+
+// signals queued for each step in a parallel group
+const stepSignalQueueSize = 16
+
+// signalBroadcaster relays each signal to all subscribers. It also remembers
+// the first signal terminating the group so that steps which have not
+// started yet are skipped instead of missing it. Signals which no step
+// receives are acked as ignored.
+type signalBroadcaster struct {
+	subscribers map[chan *signal]bool
+	terminated  *signal
+	acker       *SignalAcker
+	mutex       sync.Mutex
+	doneCh      chan struct{}
+	exitedCh    chan struct{}
+}
+
+func newSignalBroadcaster(signalCh <-chan *signal, acker *SignalAcker) *signalBroadcaster {
+	b := &signalBroadcaster{
+		subscribers: map[chan *signal]bool{},
+		acker:       acker,
+		mutex:       sync.Mutex{},
+		doneCh:      make(chan struct{}),
+		exitedCh:    make(chan struct{}),
+	}
+
+	go func() {
+		defer close(b.exitedCh)
+		for {
+			select {
+			case s := <-signalCh:
+				b.broadcast(s)
+			case <-b.doneCh:
+				return
+			}
+		}
+	}()
+
+	return b
+}
+
+func (b *signalBroadcaster) broadcast(s *signal) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	terminates := s.invalid == nil && s.terminates()
+	if b.terminated == nil && terminates {
+		b.terminated = s
+	}
+	if len(b.subscribers) == 0 {
+		if terminates {
+			// no step is running; pending steps are skipped
+			b.acker.Ack(s, int(s.number), nil, nil)
+		} else {
+			log.Printf("[INFO] Ignoring a signal because no step is running: %+v", s)
+			b.acker.Ignore(s, "no step is running")
+		}
+		return
+	}
+	for ch := range b.subscribers {
+		select {
+		case ch <- s:
+		default:
+			log.Printf("[WARN] Dropping a signal because the step has not handled earlier ones: %+v", s)
+			b.acker.Ignore(s, "the step is not accepting signals")
+		}
+	}
+}
+
+// subscribe returns a channel receiving signals from now on, and the signal
+// which has already terminated the group if any.
+func (b *signalBroadcaster) subscribe() (chan *signal, *signal) {
+	ch := make(chan *signal, stepSignalQueueSize)
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.subscribers[ch] = true
+	return ch, b.terminated
+}
+
+// unsubscribe stops relaying signals to ch. Signals left in ch are acked as ignored.
+func (b *signalBroadcaster) unsubscribe(ch chan *signal) {
+	b.mutex.Lock()
+	delete(b.subscribers, ch)
+	b.mutex.Unlock()
+
+	for {
+		select {
+		case s := <-ch:
+			b.acker.Ignore(s, "the step has finished")
+		default:
+			return
+		}
+	}
+}
+
+func (b *signalBroadcaster) stop() {
+	close(b.doneCh)
+	<-b.exitedCh
+}
+
+// forStep returns a runner for a step in a parallel group, whose output is
+// prefixed with the step name or written to its own log stream.
+func (r *jobRunner) forStep(step string, separate bool, signalCh <-chan *signal) (*jobRunner, error) {
+	sub := *r
+	sub.signalCh = signalCh
+	if r.output == nil {
+		return &sub, nil
+	}
+
+	if separate && r.stepLogs != nil {
+		if err := r.stepLogs.separate(step); err != nil {
+			return nil, err
+		}
+	} else {
+		separate = false
+	}
+	sub.stdout = r.output.StepStream(streamStdout, step, !separate)
+	sub.stderr = r.output.StepStream(streamStderr, step, !separate)
+	return &sub, nil
+}
+
+// runGroup runs the steps of a parallel group at most MaxParallelism at a
+// time. Signals are sent to all running steps. The exit status of the group is
+// that of the first failed step in definition order which is not "continue".
+// The outcome is returned with the first error of steps which the agent
+// failed to run.
+func (r *jobRunner) runGroup(g Step, defaultBucket string) (*stepOutcome, error) {
+	max := g.MaxParallelism
+	if max <= 0 || max > len(g.Parallel) {
+		max = len(g.Parallel)
+	}
+
+	sr := stepResult{
+		Name:      g.Name,
+		StartedAt: time.Now(),
+	}
+
+	broadcaster := newSignalBroadcaster(r.signalCh, r.acker)
+	defer broadcaster.stop()
+
+	outcomes := make([]*stepOutcome, len(g.Parallel))
+	errs := make([]error, len(g.Parallel))
+	sem := make(chan struct{}, max)
+	var wg sync.WaitGroup
+
+	for i, s := range g.Parallel {
+		wg.Add(1)
+		go func(i int, s Step) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			if r.shutdown.isSet() {
+				fmt.Fprintf(r.out, "[step %s skipped: %s]\n", s.Name, errAgentShuttingDown)
+				outcomes[i] = &stepOutcome{
+					result:     stepResult{Name: s.Name},
+					exitStatus: errorExitStatus,
+					exitErr:    errAgentShuttingDown,
+				}
+				return
+			}
+
+			signalCh, terminated := broadcaster.subscribe()
+			defer broadcaster.unsubscribe(signalCh)
+			if terminated != nil {
+				err := fmt.Errorf("the group is stopped by %s", terminated)
+				fmt.Fprintf(r.out, "[step %s skipped: %s]\n", s.Name, err)
+				outcomes[i] = &stepOutcome{
+					result:     stepResult{Name: s.Name},
+					exitStatus: errorExitStatus,
+					exitErr:    err,
+				}
+				return
+			}
+
+			sub, err := r.forStep(s.Name, g.SeparateLogStreams, signalCh)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+
+			log.Printf("[INFO] Starting step %s in %s", s.Name, g.Name)
+			fmt.Fprintf(r.out, "[step %s: started]\n", s.Name)
+			o, err := sub.runStep(s, defaultBucket)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			if o.exitErr == nil {
+				fmt.Fprintf(r.out, "[step %s: exit status %d]\n", s.Name, o.exitStatus)
+			} else {
+				fmt.Fprintf(r.out, "[step %s: %s]\n", s.Name, o.exitErr)
+			}
+			outcomes[i] = o
+		}(i, s)
+	}
+	wg.Wait()
+	sr.FinishedAt = time.Now()
+
+	// steps which the agent failed to run are failed steps of the group
+	var agentErr error
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		if err != errAgentShuttingDown {
+			log.Printf("[ERROR] Failed to run step %s: %s", g.Parallel[i].Name, err)
+			if agentErr == nil {
+				agentErr = err
+			}
+		}
+		fmt.Fprintf(r.out, "[step %s: %s]\n", g.Parallel[i].Name, err)
+		outcomes[i] = agentFailure(g.Parallel[i], err)
+	}
+
+	group := &stepOutcome{}
+	failed := false
+	for i, o := range outcomes {
+		sr.Steps = append(sr.Steps, o.result)
+		if failed || (o.exitErr == nil && o.exitStatus == 0) {
+			continue
+		}
+		if action, _ := g.Parallel[i].onFailure(); action == onFailureContinue {
+			continue
+		}
+		failed = true
+		group.exitStatus, group.exitErr = o.exitStatus, o.exitErr
+	}
+	if group.exitErr == nil {
+		sr.ExitStatus = aws.Int(group.exitStatus)
+	}
+	group.result = sr
+
+	return group, agentErr
+}
@@ -0,0 +1,123 @@
+package paramedic
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const redacted = "[REDACTED]"
+
+var builtinRedactionPatterns = []string{
+	`\b(AKIA|ASIA)[0-9A-Z]{16}\b`,                                     // AWS access key ID
+	`(?i)aws_secret_access_key["']?\s*[=:]\s*["']?[A-Za-z0-9/+=]{40}`, // AWS secret access key
+	`(?i)\bbearer\s+[A-Za-z0-9\-._~+/]+=*`,                            // bearer token
+	`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`,                // email address
+}
+
+var (
+	privateKeyBeginPattern = regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY( BLOCK)?-----`)
+	privateKeyEndPattern   = regexp.MustCompile(`-----END [A-Z ]*PRIVATE KEY( BLOCK)?-----`)
+)
+
+// Redaction configures Redactor. It can be given in the config file and the job manifest.
+type Redaction struct {
+	BuiltinDetectors bool     `yaml:"BuiltinDetectors"` // AWS access keys, bearer tokens, private key blocks and email addresses
+	Patterns         []string `yaml:"Patterns"`
+	Literals         []string `yaml:"Literals"`
+}
+
+// Redactor masks secrets in output lines. Lines are redacted after being
+// split, so a secret is detected even if it spans Write chunk boundaries.
+type Redactor struct {
+	patterns    []*regexp.Regexp
+	literals    []string
+	privateKeys bool
+	count       int64
+	mutex       sync.Mutex
+}
+
+// redactState is kept per output stream to track multi-line private key blocks.
+type redactState struct {
+	inPrivateKey bool
+}
+
+func NewRedactor(redactions ...Redaction) (*Redactor, error) {
+	r := &Redactor{
+		patterns: []*regexp.Regexp{},
+		literals: []string{},
+		mutex:    sync.Mutex{},
+	}
+
+	for _, rd := range redactions {
+		patterns := rd.Patterns
+		if rd.BuiltinDetectors && !r.privateKeys {
+			patterns = append(append([]string{}, builtinRedactionPatterns...), patterns...)
+			r.privateKeys = true
+		}
+		for _, p := range patterns {
+			re, err := regexp.Compile(p)
+			if err != nil {
+				return nil, fmt.Errorf("invalid redaction pattern: %s", err)
+			}
+			r.patterns = append(r.patterns, re)
+		}
+		r.AddLiterals(rd.Literals...)
+	}
+
+	return r, nil
+}
+
+// AddLiterals adds values to be masked wherever they appear.
+func (r *Redactor) AddLiterals(values ...string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, v := range values {
+		if v != "" {
+			r.literals = append(r.literals, v)
+		}
+	}
+}
+
+// Count returns how many redactions happened.
+func (r *Redactor) Count() int64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.count
+}
+
+func (r *Redactor) redact(line string, state *redactState) string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.privateKeys {
+		if state.inPrivateKey {
+			if privateKeyEndPattern.MatchString(line) {
+				state.inPrivateKey = false
+			}
+			return redacted
+		}
+		if privateKeyBeginPattern.MatchString(line) {
+			r.count++
+			state.inPrivateKey = !privateKeyEndPattern.MatchString(line)
+			return redacted
+		}
+	}
+
+	for _, l := range r.literals {
+		if n := strings.Count(line, l); n > 0 {
+			r.count += int64(n)
+			line = strings.Replace(line, l, redacted, -1)
+		}
+	}
+	for _, p := range r.patterns {
+		line = p.ReplaceAllStringFunc(line, func(string) string {
+			r.count++
+			return redacted
+		})
+	}
+
+	return line
+}
@@ -0,0 +1,85 @@
+package paramedic
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+type runResult struct {
+	InstanceID     string          `json:"instanceId"`
+	RunID          string          `json:"runId"`
+	AgentVersion   string          `json:"agentVersion"`
+	ScriptLocation string          `json:"scriptLocation"`
+	ScriptVersion  string          `json:"scriptVersion,omitempty"`
+	StartedAt      time.Time       `json:"startedAt"`
+	FinishedAt     time.Time       `json:"finishedAt"`
+	ExitStatus     *int            `json:"exitStatus"` // nil if the command did not exit normally
+	Signal         *int            `json:"signal"`     // signal which terminated the command
+	TimedOut       bool            `json:"timedOut"`
+	Error          string          `json:"error,omitempty"` // error of the agent itself
+	BytesEmitted   int64           `json:"bytesEmitted"`
+	LinesEmitted   int64           `json:"linesEmitted"`
+	Attempts       []attemptResult `json:"attempts,omitempty"` // only if retry is enabled
+	Steps          []stepResult    `json:"steps,omitempty"`    // only if the job has steps
+	Redactions     int64           `json:"redactions"`
+	Verdict        string          `json:"verdict,omitempty"` // "success" or "failure" if success criteria are declared
+	VerdictReason  string          `json:"verdictReason,omitempty"`
+
+	// reported by the script through control lines
+	Outputs  map[string]string `json:"outputs,omitempty"`
+	Progress *int              `json:"progress,omitempty"`
+	Warnings []string          `json:"warnings,omitempty"`
+}
+
+type attemptResult struct {
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt"`
+	ExitStatus *int      `json:"exitStatus"`
+	Signal     *int      `json:"signal"`
+	TimedOut   bool      `json:"timedOut"`
+}
+
+func newRunResult(options *Options) *runResult {
+	r := &runResult{
+		RunID:        options.RunID,
+		AgentVersion: Version,
+		StartedAt:    time.Now(),
+	}
+	if options.ScriptS3Key != "" { // otherwise, see the locations of steps
+		r.ScriptLocation = fmt.Sprintf("s3://%s/%s", options.ScriptS3Bucket, options.ScriptS3Key)
+	}
+	return r
+}
+
+// runResultKey returns the key of the result of a run. Each run of an
+// instance gets its own object so that earlier results are kept.
+func runResultKey(prefix string, instanceID string, runID string) string {
+	return fmt.Sprintf("%s%s/%s.json", prefix, instanceID, runID)
+}
+
+func putJSONObject(client S3, bucket string, key string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(b),
+		ContentType: aws.String("application/json"),
+	}
+	_, err = client.PutObject(input)
+	return err
+}
+
+func uploadRunResult(client S3, bucket string, key string, r *runResult) error {
+	log.Printf("[INFO] Uploading a result to s3://%s/%s", bucket, key)
+	return putJSONObject(client, bucket, key, r)
+}
@@ -0,0 +1,51 @@
+package paramedic
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/golang/mock/gomock"
+	"github.com/ryotarai/paramedic-agent/mock"
+)
+
+func TestRunResultKey(t *testing.T) {
+	key := runResultKey("results/", "i-123", "run-1")
+	if key != "results/i-123/run-1.json" {
+		t.Errorf("got %s but expected results/i-123/run-1.json", key)
+	}
+	if runResultKey("results/", "i-123", "run-2") == key {
+		t.Errorf("runs should not share a result key")
+	}
+}
+
+func TestUploadRunResult(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	s3m := mock.NewMockS3(mockCtrl)
+
+	r := newRunResult(&Options{RunID: "run-1", ScriptS3Bucket: "b", ScriptS3Key: "script.sh"})
+	r.InstanceID = "i-123"
+	r.ExitStatus = aws.Int(3)
+
+	s3m.EXPECT().PutObject(gomock.Any()).Do(func(input *s3.PutObjectInput) {
+		if aws.StringValue(input.Key) != "results/i-123/run-1.json" || aws.StringValue(input.ContentType) != "application/json" {
+			t.Errorf("got %s (%s)", aws.StringValue(input.Key), aws.StringValue(input.ContentType))
+		}
+		got := map[string]interface{}{}
+		if err := json.NewDecoder(input.Body).Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		if got["runId"] != "run-1" || got["instanceId"] != "i-123" || got["scriptLocation"] != "s3://b/script.sh" || got["exitStatus"] != float64(3) {
+			t.Errorf("got %v", got)
+		}
+		if got["signal"] != nil {
+			t.Errorf("got signal %v but expected null", got["signal"])
+		}
+	}).Return(&s3.PutObjectOutput{}, nil)
+
+	if err := uploadRunResult(s3m, "b", runResultKey("results/", r.InstanceID, r.RunID), r); err != nil {
+		t.Fatal(err)
+	}
+}
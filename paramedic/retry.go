@@ -0,0 +1,62 @@
+package paramedic
+
+import (
+	"time"
+)
+
+// RetryPolicy retries a failed script inside the agent.
+type RetryPolicy struct {
+	MaxAttempts int           `yaml:"MaxAttempts"` // including the first attempt
+	Backoff     time.Duration `yaml:"Backoff"`     // wait before the second attempt, doubled for each retry (default: 10s)
+	MaxBackoff  time.Duration `yaml:"MaxBackoff"`  // default: 5m
+	ExitCodes   []int         `yaml:"ExitCodes"`   // retryable exit codes (default: any non-zero)
+}
+
+func (p RetryPolicy) enabled() bool {
+	return p.MaxAttempts > 1
+}
+
+// retryable returns whether another attempt should be made after attempt
+// (1-origin) exited with exitStatus. If criteria is given, the attempt failed
+// when its verdict is failure instead of when it exited with non-zero.
+// Abnormal exits (e.g. by signals) are not retried.
+func (p RetryPolicy) retryable(attempt int, exitStatus int, exitErr error, criteria *criteriaEvaluator) bool {
+	if attempt >= p.MaxAttempts || exitErr != nil {
+		return false
+	}
+	if criteria != nil {
+		if criteria.evaluate(exitStatus).success {
+			return false
+		}
+	} else if exitStatus == 0 {
+		return false
+	}
+	if len(p.ExitCodes) == 0 {
+		return true
+	}
+	for _, c := range p.ExitCodes {
+		if c == exitStatus {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff returns the wait before the attempt following attempt (1-origin).
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	d := p.Backoff
+	if d <= 0 {
+		d = 10 * time.Second
+	}
+	max := p.MaxBackoff
+	if max <= 0 {
+		max = 5 * time.Minute
+	}
+	for i := 1; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
@@ -0,0 +1,120 @@
+package paramedic
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/golang/mock/gomock"
+	"github.com/ryotarai/paramedic-agent/mock"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	p := RetryPolicy{
+		MaxAttempts: 3,
+		Backoff:     time.Second,
+		MaxBackoff:  3 * time.Second,
+		ExitCodes:   []int{75},
+	}
+
+	if !p.retryable(1, 75, nil, nil) {
+		t.Error("exit status 75 should be retryable")
+	}
+	if p.retryable(1, 1, nil, nil) {
+		t.Error("exit status 1 should not be retryable")
+	}
+	if p.retryable(3, 75, nil, nil) {
+		t.Error("the last attempt should not be retried")
+	}
+	if p.retryable(1, 255, errors.New("the process did not exit properly"), nil) {
+		t.Error("an abnormal exit should not be retried")
+	}
+
+	for attempt, expected := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 3 * time.Second} {
+		if got := p.backoff(attempt); got != expected {
+			t.Errorf("backoff after attempt %d is %s but expected %s", attempt, got, expected)
+		}
+	}
+}
+
+func TestRetryPolicy_SuccessCriteria(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 3}
+	criteria, err := newCriteriaEvaluator(SuccessCriteria{
+		ExitCodes:   []int{0, 1},
+		MustContain: []string{"^done$"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	criteria.writeEntries([]logEntry{{text: "done", stream: streamStdout}})
+	if p.retryable(1, 1, nil, criteria) {
+		t.Error("an accepted exit code should not be retried")
+	}
+	if !p.retryable(1, 2, nil, criteria) {
+		t.Error("exit status 2 is not accepted and should be retried")
+	}
+
+	criteria.reset()
+	criteria.writeEntries([]logEntry{{text: "not yet", stream: streamStdout}})
+	if !p.retryable(1, 0, nil, criteria) {
+		t.Error("exit status 0 failing MustContain should be retried")
+	}
+
+	p.ExitCodes = []int{75}
+	if p.retryable(1, 0, nil, criteria) {
+		t.Error("exit status 0 is not retryable by ExitCodes")
+	}
+}
+
+func TestJobRunner_RetryUnterminatedOutput(t *testing.T) {
+	cases := []struct {
+		script   string
+		attempts int
+	}{
+		// the unterminated line satisfies the criteria
+		{"#!/bin/sh\nprintf done\n", 1},
+		// it is not joined with the line of the next attempt
+		{"#!/bin/sh\nprintf done\nexit 1\n", 2},
+	}
+	for _, c := range cases {
+		mockCtrl := gomock.NewController(t)
+		s3m := mock.NewMockS3(mockCtrl)
+		body := &stringReadCloser{strings.NewReader(c.script)}
+		s3m.EXPECT().GetObject(gomock.Any()).Return(&s3.GetObjectOutput{Body: body}, nil)
+
+		criteria, err := newCriteriaEvaluator(SuccessCriteria{MustContain: []string{"^done$"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := &bytes.Buffer{}
+		output := NewOutput(nil)
+		output.AddRawWriter(buf)
+		output.AddEntryWriter(criteria)
+		r := &jobRunner{
+			clients:    &awsClients{s3: s3m},
+			output:     output,
+			out:        output.Stream(streamAgent),
+			stdout:     output.Stream(streamStdout),
+			stderr:     output.Stream(streamStderr),
+			criteria:   criteria,
+			inheritEnv: "all",
+		}
+		run, err := r.runScript("b", "script", 0, RetryPolicy{MaxAttempts: 2, Backoff: time.Millisecond}, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		output.Flush()
+
+		if len(run.attempts) != c.attempts {
+			t.Errorf("got %d attempts but expected %d:\n%s", len(run.attempts), c.attempts, buf.String())
+		}
+		if strings.Count(buf.String(), "done\n") != c.attempts || strings.Contains(buf.String(), "donedone") {
+			t.Errorf("each attempt should output its own line:\n%s", buf.String())
+		}
+		mockCtrl.Finish()
+	}
+}
@@ -0,0 +1,21 @@
+package paramedic
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestNewRunID(t *testing.T) {
+	re := regexp.MustCompile(`^[0-9a-f]{16}$`)
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		id := newRunID()
+		if !re.MatchString(id) {
+			t.Errorf("got %q but expected 16 hex digits", id)
+		}
+		if seen[id] {
+			t.Errorf("%s is generated twice", id)
+		}
+		seen[id] = true
+	}
+}
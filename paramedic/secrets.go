@@ -0,0 +1,134 @@
+package paramedic
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ssm"
+)
+
+const ssmReferencePrefix = "ssm:"
+
+const ssmMaxParametersPerRequest = 10
+
+// resolveEnvironment resolves values in the form of "ssm:/path/name" with
+// SSM Parameter Store (SecureString parameters are decrypted). It returns
+// plain values and resolved secrets separately. Secret values are never logged.
+func resolveEnvironment(client SSM, env map[string]string) (map[string]string, map[string]string, error) {
+	plain := map[string]string{}
+	refs := map[string][]string{} // parameter name -> env names
+	for k, v := range env {
+		if strings.HasPrefix(v, ssmReferencePrefix) {
+			n := strings.TrimPrefix(v, ssmReferencePrefix)
+			refs[n] = append(refs[n], k)
+		} else {
+			plain[k] = v
+		}
+	}
+
+	names := []string{}
+	for n := range refs {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	secrets := map[string]string{}
+	for len(names) > 0 {
+		n := len(names)
+		if n > ssmMaxParametersPerRequest {
+			n = ssmMaxParametersPerRequest
+		}
+		batch := names[:n]
+		names = names[n:]
+
+		log.Printf("[INFO] Fetching SSM parameters: %s", strings.Join(batch, ", "))
+		output, err := client.GetParameters(&ssm.GetParametersInput{
+			Names:          aws.StringSlice(batch),
+			WithDecryption: aws.Bool(true),
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(output.InvalidParameters) > 0 {
+			return nil, nil, fmt.Errorf("SSM parameters not found: %s", strings.Join(aws.StringValueSlice(output.InvalidParameters), ", "))
+		}
+		for _, p := range output.Parameters {
+			for _, k := range refs[aws.StringValue(p.Name)] {
+				secrets[k] = aws.StringValue(p.Value)
+			}
+		}
+	}
+
+	return plain, secrets, nil
+}
+
+// secretLiterals returns values to be redacted from output, including each
+// line of multi-line values since output is redacted line by line.
+func secretLiterals(secrets map[string]string) []string {
+	literals := []string{}
+	for _, v := range secrets {
+		literals = append(literals, v)
+		if strings.Contains(v, "\n") {
+			for _, l := range strings.Split(v, "\n") {
+				if strings.TrimSpace(l) != "" {
+					literals = append(literals, l)
+				}
+			}
+		}
+	}
+	return literals
+}
+
+// writeSecretsFile writes secrets to a file readable only by the owner in a
+// form that can be sourced by shell scripts, and returns its path. The file
+// is removed on any error so that no partial secrets are left behind.
+func writeSecretsFile(secrets map[string]string) (path string, err error) {
+	f, err := ioutil.TempFile("", "paramedic-secrets")
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(f.Name())
+			path = ""
+		}
+	}()
+
+	if err := f.Chmod(0600); err != nil {
+		return "", err
+	}
+	for _, k := range sortedKeys(secrets) {
+		v := strings.Replace(secrets[k], "'", `'\''`, -1)
+		if _, err := fmt.Fprintf(f, "export %s='%s'\n", k, v); err != nil {
+			return "", err
+		}
+	}
+
+	return f.Name(), nil
+}
+
+// envList converts a map to a list of "KEY=value" in key order.
+func envList(env map[string]string) []string {
+	list := []string{}
+	for _, k := range sortedKeys(env) {
+		list = append(list, k+"="+env[k])
+	}
+	return list
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
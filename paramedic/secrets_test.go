@@ -0,0 +1,142 @@
+package paramedic
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/golang/mock/gomock"
+	"github.com/ryotarai/paramedic-agent/mock"
+)
+
+func parametersOutput(names []string) *ssm.GetParametersOutput {
+	output := &ssm.GetParametersOutput{}
+	for _, n := range names {
+		output.Parameters = append(output.Parameters, &ssm.Parameter{
+			Name:  aws.String(n),
+			Value: aws.String("value of " + n),
+		})
+	}
+	return output
+}
+
+func TestResolveEnvironment(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	ssmm := mock.NewMockSSM(mockCtrl)
+
+	env := map[string]string{
+		"APP_ENV":      "production",
+		"DB_PASSWORD":  "ssm:/app/db/password",
+		"DB_PASSWORD2": "ssm:/app/db/password", // the same parameter
+	}
+	names := []string{"/app/db/password"}
+	// more parameters than a single request can fetch
+	for i := 0; i < 10; i++ {
+		env[fmt.Sprintf("TOKEN_%d", i)] = fmt.Sprintf("ssm:/app/token/%d", i)
+		names = append(names, fmt.Sprintf("/app/token/%d", i))
+	}
+	sort.Strings(names)
+
+	gomock.InOrder(
+		ssmm.EXPECT().GetParameters(&ssm.GetParametersInput{
+			Names:          aws.StringSlice(names[:10]),
+			WithDecryption: aws.Bool(true),
+		}).Return(parametersOutput(names[:10]), nil),
+		ssmm.EXPECT().GetParameters(&ssm.GetParametersInput{
+			Names:          aws.StringSlice(names[10:]),
+			WithDecryption: aws.Bool(true),
+		}).Return(parametersOutput(names[10:]), nil),
+	)
+
+	plain, secrets, err := resolveEnvironment(ssmm, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plain) != 1 || plain["APP_ENV"] != "production" {
+		t.Errorf("got plain values %v", plain)
+	}
+	if len(secrets) != 12 {
+		t.Errorf("got %d secrets but expected 12", len(secrets))
+	}
+	if secrets["DB_PASSWORD"] != "value of /app/db/password" || secrets["DB_PASSWORD2"] != "value of /app/db/password" || secrets["TOKEN_9"] != "value of /app/token/9" {
+		t.Errorf("got secrets %v", secrets)
+	}
+}
+
+func TestResolveEnvironment_NotFound(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	ssmm := mock.NewMockSSM(mockCtrl)
+
+	ssmm.EXPECT().GetParameters(gomock.Any()).Return(&ssm.GetParametersOutput{
+		InvalidParameters: aws.StringSlice([]string{"/app/missing"}),
+	}, nil)
+
+	_, _, err := resolveEnvironment(ssmm, map[string]string{"X": "ssm:/app/missing"})
+	if err == nil || !strings.Contains(err.Error(), "/app/missing") {
+		t.Errorf("got %v but expected an error about /app/missing", err)
+	}
+}
+
+func TestResolveEnvironment_WithoutReferences(t *testing.T) {
+	// SSM is not called without references
+	plain, secrets, err := resolveEnvironment(nil, map[string]string{"A": "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain["A"] != "1" || len(secrets) != 0 {
+		t.Errorf("got %v and %v", plain, secrets)
+	}
+}
+
+func TestSecretLiterals(t *testing.T) {
+	literals := secretLiterals(map[string]string{
+		"A": "single",
+		"B": "-----BEGIN KEY-----\nabc\n\n-----END KEY-----",
+	})
+	sort.Strings(literals)
+	expected := []string{
+		"-----BEGIN KEY-----",
+		"-----BEGIN KEY-----\nabc\n\n-----END KEY-----",
+		"-----END KEY-----",
+		"abc",
+		"single",
+	}
+	if strings.Join(literals, "|") != strings.Join(expected, "|") {
+		t.Errorf("got %q but expected %q", literals, expected)
+	}
+}
+
+func TestWriteSecretsFile(t *testing.T) {
+	secrets := map[string]string{
+		"PASSWORD": "it's a secret",
+		"KEY":      "line1\nline2",
+	}
+	path, err := writeSecretsFile(secrets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("got mode %s but expected 0600", info.Mode())
+	}
+
+	out, err := exec.Command("/bin/sh", "-c", `. "$0" && printf '%s|%s' "$PASSWORD" "$KEY"`, path).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "it's a secret|line1\nline2" {
+		t.Errorf("got %q after sourcing the file", out)
+	}
+}
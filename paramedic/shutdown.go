@@ -0,0 +1,140 @@
+package paramedic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	ossignal "os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultShutdownGracePeriod = 20 * time.Second
+	// the output is given up after this even without a signal to the agent
+	finalFlushTimeout = 5 * time.Minute
+)
+
+var errAgentShuttingDown = errors.New("the agent is shutting down")
+
+// shutdownFlag is set once the agent is asked to terminate, so that no more
+// steps or attempts are started. All methods are no-op on a nil shutdownFlag.
+type shutdownFlag struct {
+	once   sync.Once
+	ch     chan struct{}
+	signal os.Signal
+}
+
+func newShutdownFlag() *shutdownFlag {
+	return &shutdownFlag{
+		ch: make(chan struct{}),
+	}
+}
+
+func (f *shutdownFlag) set(sig os.Signal) {
+	if f == nil {
+		return
+	}
+	f.once.Do(func() {
+		f.signal = sig
+		close(f.ch)
+	})
+}
+
+func (f *shutdownFlag) isSet() bool {
+	if f == nil {
+		return false
+	}
+	select {
+	case <-f.ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// trapTermination traps SIGTERM, SIGINT and SIGHUP sent to the agent, e.g. when
+// the command is cancelled or the instance shuts down. While ctx is alive, each
+// of them is forwarded to the process group of the script, followed by SIGKILL
+// after grace, instead of terminating the agent. Once ctx is done, they are
+// only recorded in flag so that the final flush is cut short by flushWithin.
+// The returned function stops trapping.
+func trapTermination(ctx context.Context, signalCh chan<- *signal, out io.Writer, grace time.Duration, flag *shutdownFlag) func() {
+	osSignals := make(chan os.Signal, 1)
+	ossignal.Notify(osSignals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	stopCh := make(chan struct{})
+
+	go func() {
+		for n := 1; ; n++ {
+			var sig os.Signal
+			select {
+			case sig = <-osSignals:
+			case <-stopCh:
+				return
+			}
+
+			flag.set(sig)
+			if ctx.Err() != nil {
+				// the output may be closed already, so this goes only to the agent's log
+				log.Printf("[INFO] The agent received %s while flushing the output, exiting within %s", sig, grace)
+				continue
+			}
+
+			log.Printf("[INFO] The agent received %s, forwarding it to the script", sig)
+			fmt.Fprintf(out, "[agent received %s, forwarding it to the script]\n", sig)
+
+			s := &signal{
+				Action:   signalActionEscalate,
+				number:   sig.(syscall.Signal),
+				duration: grace,
+				group:    true,
+				identity: fmt.Sprintf("agent %d", n),
+			}
+			select {
+			case signalCh <- s:
+			case <-ctx.Done():
+			case <-stopCh:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		ossignal.Stop(osSignals)
+		close(stopCh)
+	}
+}
+
+// flushWithin runs flush and waits for it for up to timeout, or up to grace
+// once flag is set. It returns false if flush is given up.
+func flushWithin(flush func(), timeout time.Duration, grace time.Duration, flag *shutdownFlag) bool {
+	doneCh := make(chan struct{})
+	go func() {
+		flush()
+		close(doneCh)
+	}()
+
+	timeoutCh := time.After(timeout)
+	var flagCh <-chan struct{}
+	if flag != nil {
+		flagCh = flag.ch
+	}
+	var graceCh <-chan time.Time
+	for {
+		select {
+		case <-doneCh:
+			return true
+		case <-flagCh:
+			flagCh = nil
+			graceCh = time.After(grace)
+		case <-graceCh:
+			return false
+		case <-timeoutCh:
+			return false
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package paramedic
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestTrapTermination(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	signalCh := make(chan *signal, 1)
+	flag := newShutdownFlag()
+	out := &bytes.Buffer{}
+	stop := trapTermination(ctx, signalCh, out, 5*time.Second, flag)
+	defer stop()
+
+	if err := syscall.Kill(syscall.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case s := <-signalCh:
+		if s.Action != signalActionEscalate || s.number != syscall.SIGHUP || s.duration != 5*time.Second || !s.group {
+			t.Errorf("got %+v but expected escalating SIGHUP to the process group", s)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the signal was not forwarded")
+	}
+	if !flag.isSet() || flag.signal != syscall.SIGHUP {
+		t.Errorf("the shutdown flag should be set by SIGHUP")
+	}
+}
+
+func TestTrapTermination_AfterJob(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel() // the job is over
+
+	signalCh := make(chan *signal, 1)
+	flag := newShutdownFlag()
+	stop := trapTermination(ctx, signalCh, &bytes.Buffer{}, 5*time.Second, flag)
+	defer stop()
+
+	if err := syscall.Kill(syscall.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-flag.ch:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the shutdown flag was not set")
+	}
+	if flag.signal != syscall.SIGHUP {
+		t.Errorf("got %s but expected SIGHUP", flag.signal)
+	}
+	select {
+	case s := <-signalCh:
+		t.Errorf("%+v should not be forwarded after the job", s)
+	default:
+	}
+}
+
+func TestFlushWithin(t *testing.T) {
+	if !flushWithin(func() {}, time.Minute, time.Minute, newShutdownFlag()) {
+		t.Error("a finished flush should not be given up")
+	}
+
+	block := make(chan struct{})
+	defer close(block)
+	if flushWithin(func() { <-block }, 10*time.Millisecond, time.Minute, newShutdownFlag()) {
+		t.Error("a flush should be given up after the timeout")
+	}
+
+	flag := newShutdownFlag()
+	flag.set(syscall.SIGTERM)
+	start := time.Now()
+	if flushWithin(func() { <-block }, time.Minute, 10*time.Millisecond, flag) {
+		t.Error("a flush should be given up after the grace period once the agent is asked to terminate")
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("the flush was given up after %s", d)
+	}
+}
+
+func TestJobRunner_RunStepsShuttingDown(t *testing.T) {
+	flag := newShutdownFlag()
+	flag.set(syscall.SIGTERM)
+
+	out := &bytes.Buffer{}
+	r := &jobRunner{
+		out:      out,
+		stdout:   out,
+		stderr:   out,
+		shutdown: flag,
+	}
+	steps := []Step{
+		{Name: "drain", ScriptS3Key: "drain"},
+		{Name: "undrain", ScriptS3Key: "undrain"},
+	}
+	job, err := r.runSteps(steps, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if job.exitErr != errAgentShuttingDown || job.exitStatus != errorExitStatus {
+		t.Errorf("got exit status %d (%v) but expected %v", job.exitStatus, job.exitErr, errAgentShuttingDown)
+	}
+	if len(job.steps) != 0 {
+		t.Errorf("got steps %v but expected none", job.steps)
+	}
+	for _, name := range []string{"drain", "undrain"} {
+		if !strings.Contains(out.String(), "[step "+name+" skipped") {
+			t.Errorf("step %s should be reported as skipped:\n%s", name, out.String())
+		}
+	}
+}
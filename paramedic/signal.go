@@ -0,0 +1,191 @@
+package paramedic
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// signalSchemaVersion is the latest version of the signal object. Version 1
+// (or no version) is a bare {"signal": <number>}.
+const signalSchemaVersion = 2
+
+const (
+	signalActionSignal          = "signal"           // send Signal to the script
+	signalActionKillTree        = "kill-tree"        // SIGKILL to all processes of the script
+	signalActionPause           = "pause"            // SIGSTOP to all processes of the script
+	signalActionResume          = "resume"           // SIGCONT to all processes of the script
+	signalActionExtendTimeout   = "extend-timeout"   // extend the timeout by Duration
+	signalActionEscalate        = "escalate"         // send Signal, then SIGKILL after Duration
+	signalActionDumpDiagnostics = "dump-diagnostics" // write the process tree of the script to the output
+)
+
+const defaultEscalationGrace = 30 * time.Second
+
+var signalNames = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"ABRT": syscall.SIGABRT,
+	"KILL": syscall.SIGKILL,
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+	"ALRM": syscall.SIGALRM,
+	"TERM": syscall.SIGTERM,
+	"CONT": syscall.SIGCONT,
+	"STOP": syscall.SIGSTOP,
+	"TSTP": syscall.SIGTSTP,
+}
+
+type signal struct {
+	Version  int             `json:"version"`
+	ID       string          `json:"id"`       // identifies the signal, defaults to the version or ETag of the object
+	Action   string          `json:"action"`   // defaults to "signal"
+	Signal   json.RawMessage `json:"signal"`   // number or name like "TERM" or "SIGTERM"
+	Duration string          `json:"duration"` // for extend-timeout and escalate
+	// RunID and IssuedAt (defaults to the last modified time of the object)
+	// scope the signal to a run and ignore leftovers of earlier runs.
+	RunID    string     `json:"runId"`
+	IssuedAt *time.Time `json:"issuedAt"`
+
+	identity     string
+	lastModified time.Time
+	number       syscall.Signal
+	duration     time.Duration
+	group        bool   // send the signal to the process group of the script
+	invalid      error  // why the signal cannot be applied, reported to the output
+	settle       func() // called once the signal is delivered or rejected, e.g. to delete its message
+}
+
+// settled reports that s has been delivered to the job or rejected, so that
+// the transport can drop it. Signals not settled are received again.
+func (s *signal) settled() {
+	if s != nil && s.settle != nil {
+		s.settle()
+		s.settle = nil
+	}
+}
+
+// parseSignalObject parses and validates a signal object.
+func parseSignalObject(data []byte) (*signal, error) {
+	s := &signal{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, err
+	}
+	s.validate()
+	return s, nil
+}
+
+// validate resolves the signal number and the duration. It sets invalid
+// instead of returning an error so that the problem can be reported to the output.
+func (s *signal) validate() {
+	s.invalid = s.resolve()
+}
+
+func (s *signal) resolve() error {
+	switch {
+	case s.Version == 0 || s.Version == 1:
+		if s.Action != "" || s.Duration != "" {
+			return fmt.Errorf("action requires version %d", signalSchemaVersion)
+		}
+		s.Action = signalActionSignal
+	case s.Version > signalSchemaVersion:
+		return fmt.Errorf("unsupported version %d", s.Version)
+	case s.Action == "":
+		s.Action = signalActionSignal
+	}
+
+	var err error
+	switch s.Action {
+	case signalActionSignal:
+		s.number, err = parseSignal(s.Signal)
+		return err
+	case signalActionEscalate:
+		s.number = syscall.SIGTERM
+		if len(s.Signal) > 0 {
+			if s.number, err = parseSignal(s.Signal); err != nil {
+				return err
+			}
+		}
+		s.duration = defaultEscalationGrace
+		if s.Duration != "" {
+			return s.parseDuration()
+		}
+		return nil
+	case signalActionExtendTimeout:
+		if s.Duration == "" {
+			return fmt.Errorf("duration is mandatory for %s", s.Action)
+		}
+		return s.parseDuration()
+	case signalActionKillTree:
+		s.number = syscall.SIGKILL
+	case signalActionPause:
+		s.number = syscall.SIGSTOP
+	case signalActionResume:
+		s.number = syscall.SIGCONT
+	case signalActionDumpDiagnostics:
+	default:
+		return fmt.Errorf("unknown action %q", s.Action)
+	}
+	return nil
+}
+
+func (s *signal) parseDuration() error {
+	d, err := time.ParseDuration(s.Duration)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q", s.Duration)
+	}
+	if d <= 0 {
+		return fmt.Errorf("duration must be positive: %s", s.Duration)
+	}
+	s.duration = d
+	return nil
+}
+
+// terminates reports whether the signal is meant to stop the script, which
+// also cancels pending retries.
+func (s *signal) terminates() bool {
+	switch s.Action {
+	case signalActionSignal, signalActionKillTree, signalActionEscalate:
+		return true
+	}
+	return false
+}
+
+func (s *signal) String() string {
+	switch s.Action {
+	case signalActionSignal:
+		return fmt.Sprintf("signal %d", s.number)
+	case signalActionEscalate:
+		return fmt.Sprintf("escalate %d, SIGKILL after %s", s.number, s.duration)
+	case signalActionExtendTimeout:
+		return fmt.Sprintf("extend-timeout %s", s.duration)
+	}
+	return s.Action
+}
+
+func parseSignal(raw json.RawMessage) (syscall.Signal, error) {
+	if len(raw) == 0 {
+		return 0, fmt.Errorf("signal is mandatory")
+	}
+
+	var n int
+	if err := json.Unmarshal(raw, &n); err == nil {
+		if n <= 0 || n >= 64 {
+			return 0, fmt.Errorf("invalid signal %d", n)
+		}
+		return syscall.Signal(n), nil
+	}
+
+	var name string
+	if err := json.Unmarshal(raw, &name); err != nil {
+		return 0, fmt.Errorf("invalid signal %s", raw)
+	}
+	sig, ok := signalNames[strings.TrimPrefix(strings.ToUpper(name), "SIG")]
+	if !ok {
+		return 0, fmt.Errorf("unknown signal %q", name)
+	}
+	return sig, nil
+}
@@ -0,0 +1,114 @@
+package paramedic
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+const (
+	sqsAttributeInstanceID = "InstanceId"
+	sqsAttributeRunID      = "RunId"
+	sqsMaxWaitTime         = 20 * time.Second
+	// messages for other instances are hidden from this agent for a while so
+	// that agents sharing a queue do not receive them in a tight loop
+	sqsReleaseVisibility = 5 * time.Second
+)
+
+// sqsSignalChannel receives signal objects as messages of an SQS queue by
+// long polling. A message can be scoped by the InstanceId and RunId message
+// attributes; messages for other instances are left in the queue for them.
+// A message is deleted once its signal is settled, so that a signal received
+// but not delivered, e.g. when the agent dies, is received again.
+type sqsSignalChannel struct {
+	sqs        SQS
+	queueURL   string
+	instanceID string
+	waitTime   time.Duration
+}
+
+func (c *sqsSignalChannel) receive(ctx context.Context, wait bool) ([]*signal, error) {
+	input := &sqs.ReceiveMessageInput{
+		QueueUrl:              aws.String(c.queueURL),
+		MaxNumberOfMessages:   aws.Int64(10),
+		AttributeNames:        []*string{aws.String(sqs.MessageSystemAttributeNameSentTimestamp)},
+		MessageAttributeNames: []*string{aws.String("All")},
+	}
+	if wait {
+		waitTime := c.waitTime
+		if waitTime <= 0 || waitTime > sqsMaxWaitTime {
+			waitTime = sqsMaxWaitTime
+		}
+		input.WaitTimeSeconds = aws.Int64(int64(waitTime / time.Second))
+	}
+
+	log.Printf("[DEBUG] Receiving signal messages from %s", c.queueURL)
+	output, err := c.sqs.ReceiveMessageWithContext(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+
+	signals := []*signal{}
+	for _, m := range output.Messages {
+		if id := messageAttribute(m, sqsAttributeInstanceID); id != "" && id != c.instanceID {
+			log.Printf("[DEBUG] Releasing a signal message for %s", id)
+			c.release(m)
+			continue
+		}
+
+		s, err := parseSignalObject([]byte(aws.StringValue(m.Body)))
+		if err != nil {
+			log.Printf("[WARN] Deleting a malformed signal message %s: %s", aws.StringValue(m.MessageId), err)
+			c.delete(m)
+			continue
+		}
+		if s.RunID == "" {
+			s.RunID = messageAttribute(m, sqsAttributeRunID)
+		}
+		if ms, err := strconv.ParseInt(aws.StringValue(m.Attributes[sqs.MessageSystemAttributeNameSentTimestamp]), 10, 64); err == nil {
+			s.lastModified = time.Unix(0, ms*int64(time.Millisecond))
+		}
+		s.identity = "sqs id:" + s.ID
+		if s.ID == "" {
+			s.identity = "sqs message:" + aws.StringValue(m.MessageId)
+		}
+
+		m := m
+		s.settle = func() { c.delete(m) }
+		signals = append(signals, s)
+	}
+	return signals, nil
+}
+
+func (c *sqsSignalChannel) delete(m *sqs.Message) {
+	_, err := c.sqs.DeleteMessage(&sqs.DeleteMessageInput{
+		QueueUrl:      aws.String(c.queueURL),
+		ReceiptHandle: m.ReceiptHandle,
+	})
+	if err != nil {
+		log.Printf("[WARN] Failed to delete a signal message: %s", err)
+	}
+}
+
+// release makes the message visible to other consumers after sqsReleaseVisibility.
+func (c *sqsSignalChannel) release(m *sqs.Message) {
+	_, err := c.sqs.ChangeMessageVisibility(&sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          aws.String(c.queueURL),
+		ReceiptHandle:     m.ReceiptHandle,
+		VisibilityTimeout: aws.Int64(int64(sqsReleaseVisibility / time.Second)),
+	})
+	if err != nil {
+		log.Printf("[WARN] Failed to release a signal message: %s", err)
+	}
+}
+
+func messageAttribute(m *sqs.Message, name string) string {
+	if v, ok := m.MessageAttributes[name]; ok {
+		return aws.StringValue(v.StringValue)
+	}
+	return ""
+}
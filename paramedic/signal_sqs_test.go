@@ -0,0 +1,225 @@
+package paramedic
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+type fakeSQSMessage struct {
+	id         string
+	body       string
+	attributes map[string]string
+	inFlight   bool
+}
+
+// fakeSQS is an SQS-compatible stand-in speaking the query protocol.
+type fakeSQS struct {
+	messages          []*fakeSQSMessage
+	deleted           []string
+	released          []string
+	visibility        []string // VisibilityTimeout of each release
+	messageAttributes []string // MessageAttributeNames of each receive
+	mutex             sync.Mutex
+}
+
+type fakeSQSAttribute struct {
+	Name  string `xml:"Name"`
+	Value string `xml:"Value"`
+}
+
+type fakeSQSMessageAttribute struct {
+	Name  string `xml:"Name"`
+	Value struct {
+		StringValue string `xml:"StringValue"`
+		DataType    string `xml:"DataType"`
+	} `xml:"Value"`
+}
+
+type fakeSQSReceivedMessage struct {
+	MessageId        string                    `xml:"MessageId"`
+	ReceiptHandle    string                    `xml:"ReceiptHandle"`
+	MD5OfBody        string                    `xml:"MD5OfBody"`
+	Body             string                    `xml:"Body"`
+	Attribute        []fakeSQSAttribute        `xml:"Attribute"`
+	MessageAttribute []fakeSQSMessageAttribute `xml:"MessageAttribute"`
+}
+
+func (f *fakeSQS) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if err := req.ParseForm(); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	action := req.Form.Get("Action")
+	var result interface{}
+	switch action {
+	case "ReceiveMessage":
+		f.messageAttributes = append(f.messageAttributes, req.Form.Get("MessageAttributeName.1"))
+		messages := []fakeSQSReceivedMessage{}
+		for _, m := range f.messages {
+			if m.inFlight {
+				continue
+			}
+			m.inFlight = true
+			sum := md5.Sum([]byte(m.body))
+			r := fakeSQSReceivedMessage{
+				MessageId:     m.id,
+				ReceiptHandle: m.id,
+				MD5OfBody:     hex.EncodeToString(sum[:]),
+				Body:          m.body,
+				Attribute:     []fakeSQSAttribute{{Name: "SentTimestamp", Value: fmt.Sprintf("%d", time.Now().UnixNano()/int64(time.Millisecond))}},
+			}
+			for k, v := range m.attributes {
+				a := fakeSQSMessageAttribute{Name: k}
+				a.Value.StringValue = v
+				a.Value.DataType = "String"
+				r.MessageAttribute = append(r.MessageAttribute, a)
+			}
+			messages = append(messages, r)
+		}
+		result = struct {
+			XMLName  xml.Name                 `xml:"ReceiveMessageResponse"`
+			Messages []fakeSQSReceivedMessage `xml:"ReceiveMessageResult>Message"`
+		}{Messages: messages}
+	case "DeleteMessage":
+		handle := req.Form.Get("ReceiptHandle")
+		kept := []*fakeSQSMessage{}
+		for _, m := range f.messages {
+			if m.id != handle {
+				kept = append(kept, m)
+			}
+		}
+		f.messages = kept
+		f.deleted = append(f.deleted, handle)
+		result = struct {
+			XMLName xml.Name `xml:"DeleteMessageResponse"`
+		}{}
+	case "ChangeMessageVisibility":
+		handle := req.Form.Get("ReceiptHandle")
+		visibility := req.Form.Get("VisibilityTimeout")
+		for _, m := range f.messages {
+			if m.id == handle && visibility == "0" {
+				m.inFlight = false
+			}
+		}
+		f.released = append(f.released, handle)
+		f.visibility = append(f.visibility, visibility)
+		result = struct {
+			XMLName xml.Name `xml:"ChangeMessageVisibilityResponse"`
+		}{}
+	default:
+		http.Error(rw, "unsupported action "+action, http.StatusBadRequest)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "text/xml")
+	xml.NewEncoder(rw).Encode(result)
+}
+
+func TestSQSSignalChannel(t *testing.T) {
+	fake := &fakeSQS{
+		messages: []*fakeSQSMessage{
+			{id: "m1", body: `{"version": 2, "signal": "TERM"}`, attributes: map[string]string{"InstanceId": "i-1", "RunId": "run-1"}},
+			{id: "m2", body: `{"version": 2, "action": "pause"}`, attributes: map[string]string{"InstanceId": "i-2"}},
+			{id: "m3", body: `{"signal": 9}`, attributes: map[string]string{"RunId": "run-0"}},
+		},
+	}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region:      aws.String("us-east-1"),
+		Endpoint:    aws.String(server.URL),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+	}))
+	w := &SignalWatcher{
+		channel: &sqsSignalChannel{
+			sqs:        sqs.New(sess),
+			queueURL:   server.URL + "/123456789012/signals",
+			instanceID: "i-1",
+		},
+		runID: "run-1",
+	}
+
+	sig, err := w.poll(context.Background(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sig == nil || sig.Action != signalActionSignal || int(sig.number) != 15 {
+		t.Errorf("got %+v but expected SIGTERM", sig)
+	}
+	if len(fake.deleted) != 0 {
+		t.Errorf("got deleted messages %v but expected none before the signal is settled", fake.deleted)
+	}
+	sig.settled()
+	// the message for run-0 is ignored
+	if sig, err := w.poll(context.Background(), false); err != nil || sig != nil {
+		t.Errorf("got %+v (%v) but expected nothing", sig, err)
+	}
+
+	if len(fake.deleted) != 2 || fake.deleted[0] != "m1" || fake.deleted[1] != "m3" {
+		t.Errorf("got deleted messages %v but expected [m1 m3]", fake.deleted)
+	}
+	if len(fake.messages) != 1 || fake.messages[0].id != "m2" {
+		t.Errorf("the message for another instance should be left in the queue")
+	}
+	if len(fake.released) != 1 || fake.released[0] != "m2" || fake.visibility[0] != "5" {
+		t.Errorf("got released messages %v (visibility %v) but expected m2 hidden for 5 seconds", fake.released, fake.visibility)
+	}
+	if len(fake.messageAttributes) == 0 || fake.messageAttributes[0] != "All" {
+		t.Errorf("got message attribute names %v but expected All", fake.messageAttributes)
+	}
+}
+
+func TestSQSSignalChannelUndelivered(t *testing.T) {
+	fake := &fakeSQS{
+		messages: []*fakeSQSMessage{
+			{id: "m1", body: `{"version": 2, "signal": "TERM"}`},
+		},
+	}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region:      aws.String("us-east-1"),
+		Endpoint:    aws.String(server.URL),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+	}))
+	w := &SignalWatcher{
+		channel: &sqsSignalChannel{
+			sqs:        sqs.New(sess),
+			queueURL:   server.URL + "/123456789012/signals",
+			instanceID: "i-1",
+		},
+		interval: time.Millisecond,
+	}
+
+	// the watcher stops before the job takes the signal
+	ctx, cancel := context.WithCancel(context.Background())
+	w.Start(ctx)
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	w.Wait()
+
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	if len(fake.deleted) != 0 {
+		t.Errorf("got deleted messages %v but the signal is not delivered", fake.deleted)
+	}
+}
@@ -0,0 +1,335 @@
+package paramedic
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/golang/mock/gomock"
+	"github.com/ryotarai/paramedic-agent/mock"
+)
+
+func TestSignalValidate(t *testing.T) {
+	cases := []struct {
+		object   string
+		action   string
+		number   syscall.Signal
+		duration time.Duration
+		invalid  bool
+	}{
+		{`{"signal": 15}`, signalActionSignal, syscall.SIGTERM, 0, false},
+		{`{"version": 2, "signal": "TERM"}`, signalActionSignal, syscall.SIGTERM, 0, false},
+		{`{"version": 2, "action": "signal", "signal": "SIGUSR1"}`, signalActionSignal, syscall.SIGUSR1, 0, false},
+		{`{"version": 2, "action": "kill-tree"}`, signalActionKillTree, syscall.SIGKILL, 0, false},
+		{`{"version": 2, "action": "pause"}`, signalActionPause, syscall.SIGSTOP, 0, false},
+		{`{"version": 2, "action": "resume"}`, signalActionResume, syscall.SIGCONT, 0, false},
+		{`{"version": 2, "action": "extend-timeout", "duration": "10m"}`, signalActionExtendTimeout, 0, 10 * time.Minute, false},
+		{`{"version": 2, "action": "escalate"}`, signalActionEscalate, syscall.SIGTERM, defaultEscalationGrace, false},
+		{`{"version": 2, "action": "escalate", "signal": "INT", "duration": "5s"}`, signalActionEscalate, syscall.SIGINT, 5 * time.Second, false},
+		{`{"version": 2, "action": "dump-diagnostics"}`, signalActionDumpDiagnostics, 0, 0, false},
+		{`{"version": 2, "action": "reboot"}`, "", 0, 0, true},
+		{`{"version": 2, "signal": "FOO"}`, "", 0, 0, true},
+		{`{"version": 2, "action": "extend-timeout"}`, "", 0, 0, true},
+		{`{"action": "kill-tree"}`, "", 0, 0, true},
+		{`{"version": 3, "signal": 15}`, "", 0, 0, true},
+	}
+
+	for _, c := range cases {
+		s := &signal{}
+		if err := json.Unmarshal([]byte(c.object), s); err != nil {
+			t.Fatal(err)
+		}
+		s.validate()
+		if c.invalid {
+			if s.invalid == nil {
+				t.Errorf("%s should be invalid", c.object)
+			}
+			continue
+		}
+		if s.invalid != nil {
+			t.Errorf("%s: %s", c.object, s.invalid)
+			continue
+		}
+		if s.Action != c.action || s.number != c.number || s.duration != c.duration {
+			t.Errorf("%s: got %s %d %s but expected %s %d %s", c.object, s.Action, s.number, s.duration, c.action, c.number, c.duration)
+		}
+	}
+}
+
+func TestParseProcStat(t *testing.T) {
+	p, pgrp, ok := parseProcStat("1234 (my script) S 1200 1234 1200 0 -1 4194304")
+	if !ok {
+		t.Fatal("failed to parse")
+	}
+	if p.pid != 1234 || p.ppid != 1200 || p.state != "S" || p.command != "my script" || pgrp != 1234 {
+		t.Errorf("unexpected result: %+v (pgrp %d)", p, pgrp)
+	}
+}
+
+// ackRecorder returns an acker whose acks are sent to the returned channel.
+func ackRecorder(t *testing.T, s3m *mock.MockS3) (*SignalAcker, <-chan signalAck) {
+	acks := make(chan signalAck, 16)
+	s3m.EXPECT().PutObject(gomock.Any()).Do(func(input *s3.PutObjectInput) {
+		b, _ := ioutil.ReadAll(input.Body)
+		ack := signalAck{}
+		if err := json.Unmarshal(b, &ack); err != nil {
+			t.Error(err)
+		}
+		acks <- ack
+	}).Return(&s3.PutObjectOutput{}, nil).AnyTimes()
+
+	acker := NewSignalAcker(s3m, "acks", "", "i-123", "run-1")
+	acker.Start()
+	return acker, acks
+}
+
+func receiveAck(t *testing.T, acks <-chan signalAck) signalAck {
+	select {
+	case ack := <-acks:
+		return ack
+	case <-time.After(5 * time.Second):
+		t.Fatal("no ack is written")
+	}
+	return signalAck{}
+}
+
+func mustParseSignal(t *testing.T, object string) *signal {
+	s, err := parseSignalObject([]byte(object))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// readyWriter is closed on the first write of the script.
+type readyWriter struct {
+	once  sync.Once
+	ready chan struct{}
+}
+
+func (w *readyWriter) Write(p []byte) (int, error) {
+	w.once.Do(func() { close(w.ready) })
+	return len(p), nil
+}
+
+// startScript runs script in background and returns the channel of its run.
+func startScript(t *testing.T, r *jobRunner, s3m *mock.MockS3, script string, timeout time.Duration) <-chan *scriptRun {
+	s3m.EXPECT().GetObject(gomock.Any()).Return(&s3.GetObjectOutput{
+		Body: &stringReadCloser{strings.NewReader(script)},
+	}, nil)
+
+	runCh := make(chan *scriptRun, 1)
+	go func() {
+		run, err := r.runScript("b", "script", timeout, RetryPolicy{}, false)
+		if err != nil {
+			t.Error(err)
+		}
+		runCh <- run
+	}()
+	return runCh
+}
+
+func waitScript(t *testing.T, runCh <-chan *scriptRun) *scriptRun {
+	select {
+	case run := <-runCh:
+		return run
+	case <-time.After(10 * time.Second):
+		t.Fatal("the script does not exit")
+	}
+	return nil
+}
+
+// waitStopped waits until the state of process pid is stopped (or not).
+func waitStopped(t *testing.T, pid int, stopped bool) {
+	for i := 0; i < 50; i++ {
+		procs, err := processGroup(pid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range procs {
+			if p.pid == pid && (p.state == "T") == stopped {
+				return
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Errorf("process %d is not stopped=%v", pid, stopped)
+}
+
+func TestJobRunner_PauseAndResume(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	s3m := mock.NewMockS3(mockCtrl)
+	acker, acks := ackRecorder(t, s3m)
+
+	signalCh := make(chan *signal)
+	r := &jobRunner{
+		clients:    &awsClients{s3: s3m},
+		out:        &bytes.Buffer{},
+		stdout:     ioutil.Discard,
+		stderr:     ioutil.Discard,
+		signalCh:   signalCh,
+		acker:      acker,
+		inheritEnv: "all",
+	}
+	runCh := startScript(t, r, s3m, "#!/bin/sh\nexec sleep 30\n", 0)
+
+	signalCh <- mustParseSignal(t, `{"version": 2, "id": "pause-1", "action": "pause"}`)
+	ack := receiveAck(t, acks)
+	if ack.SignalID != "pause-1" || ack.Signal != int(syscall.SIGSTOP) || ack.Result != ackResultDelivered || len(ack.TargetPIDs) != 1 {
+		t.Fatalf("unexpected ack: %+v", ack)
+	}
+	pid := ack.TargetPIDs[0]
+	waitStopped(t, pid, true)
+
+	signalCh <- mustParseSignal(t, `{"version": 2, "id": "resume-1", "action": "resume"}`)
+	ack = receiveAck(t, acks)
+	if ack.SignalID != "resume-1" || ack.Signal != int(syscall.SIGCONT) || ack.Result != ackResultDelivered {
+		t.Fatalf("unexpected ack: %+v", ack)
+	}
+	waitStopped(t, pid, false)
+
+	signalCh <- mustParseSignal(t, `{"version": 2, "signal": "TERM"}`)
+	receiveAck(t, acks)
+	run := waitScript(t, runCh)
+	if run.last.Signal == nil || *run.last.Signal != int(syscall.SIGTERM) {
+		t.Errorf("the script should be terminated by SIGTERM: %+v", run.last)
+	}
+	acker.Close()
+}
+
+func TestJobRunner_Escalate(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	s3m := mock.NewMockS3(mockCtrl)
+	acker, acks := ackRecorder(t, s3m)
+
+	signalCh := make(chan *signal)
+	ready := &readyWriter{ready: make(chan struct{})}
+	out := &bytes.Buffer{}
+	r := &jobRunner{
+		clients:    &awsClients{s3: s3m},
+		out:        out,
+		stdout:     ready,
+		stderr:     ioutil.Discard,
+		signalCh:   signalCh,
+		acker:      acker,
+		inheritEnv: "all",
+	}
+	// the script and its children ignore SIGTERM
+	runCh := startScript(t, r, s3m, "#!/bin/sh\ntrap '' TERM\necho ready\nsleep 30\n", 0)
+	select {
+	case <-ready.ready:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the script does not start")
+	}
+
+	start := time.Now()
+	signalCh <- mustParseSignal(t, `{"version": 2, "id": "escalate-1", "action": "escalate", "signal": "TERM", "duration": "200ms"}`)
+	ack := receiveAck(t, acks)
+	if ack.SignalID != "escalate-1" || ack.Signal != int(syscall.SIGTERM) || ack.Result != ackResultDelivered {
+		t.Errorf("unexpected ack: %+v", ack)
+	}
+	ack = receiveAck(t, acks)
+	if ack.SignalID != "escalate-1" || ack.Signal != int(syscall.SIGKILL) || ack.Result != ackResultDelivered {
+		t.Errorf("unexpected ack: %+v", ack)
+	}
+
+	run := waitScript(t, runCh)
+	if run.last.Signal == nil || *run.last.Signal != int(syscall.SIGKILL) {
+		t.Errorf("the script should be killed by SIGKILL: %+v", run.last)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("SIGKILL is sent after %s", elapsed)
+	}
+	if !strings.Contains(out.String(), "[escalated to SIGKILL]") {
+		t.Errorf("got %q", out.String())
+	}
+	acker.Close()
+}
+
+func TestJobRunner_ExtendTimeout(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	s3m := mock.NewMockS3(mockCtrl)
+	acker, acks := ackRecorder(t, s3m)
+
+	signalCh := make(chan *signal)
+	out := &bytes.Buffer{}
+	r := &jobRunner{
+		clients:    &awsClients{s3: s3m},
+		out:        out,
+		stdout:     ioutil.Discard,
+		stderr:     ioutil.Discard,
+		signalCh:   signalCh,
+		acker:      acker,
+		inheritEnv: "all",
+	}
+	start := time.Now()
+	runCh := startScript(t, r, s3m, "#!/bin/sh\nexec sleep 30\n", time.Second)
+
+	signalCh <- mustParseSignal(t, `{"version": 2, "id": "extend-1", "action": "extend-timeout", "duration": "1s"}`)
+	ack := receiveAck(t, acks)
+	if ack.SignalID != "extend-1" || ack.Action != signalActionExtendTimeout || ack.Result != ackResultDelivered || len(ack.TargetPIDs) != 1 {
+		t.Errorf("unexpected ack: %+v", ack)
+	}
+
+	run := waitScript(t, runCh)
+	if !run.last.TimedOut {
+		t.Errorf("the script should time out: %+v", run.last)
+	}
+	if elapsed := time.Since(start); elapsed < 2*time.Second {
+		t.Errorf("the script timed out after %s", elapsed)
+	}
+	if !strings.Contains(out.String(), "[timeout extended to 2s]") || !strings.Contains(out.String(), "[timed out after 2s]") {
+		t.Errorf("got %q", out.String())
+	}
+
+	// without a timeout, there is nothing to extend
+	runCh = startScript(t, r, s3m, "#!/bin/sh\nexec sleep 30\n", 0)
+	signalCh <- mustParseSignal(t, `{"version": 2, "id": "extend-2", "action": "extend-timeout", "duration": "1s"}`)
+	ack = receiveAck(t, acks)
+	if ack.SignalID != "extend-2" || ack.Result != ackResultIgnored || ack.Reason != "no timeout to extend" {
+		t.Errorf("unexpected ack: %+v", ack)
+	}
+	signalCh <- mustParseSignal(t, `{"version": 2, "signal": "KILL"}`)
+	receiveAck(t, acks)
+	waitScript(t, runCh)
+	acker.Close()
+}
+
+func TestJobRunner_WaitOrSignal(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	s3m := mock.NewMockS3(mockCtrl)
+	acker, acks := ackRecorder(t, s3m)
+
+	signalCh := make(chan *signal, 2)
+	r := &jobRunner{
+		out:      &bytes.Buffer{},
+		signalCh: signalCh,
+		acker:    acker,
+	}
+	signalCh <- mustParseSignal(t, `{"version": 2, "id": "pause-1", "action": "pause"}`)
+	signalCh <- mustParseSignal(t, `{"version": 2, "id": "stop-1", "signal": "TERM"}`)
+
+	s := r.waitOrSignal(time.Minute)
+	if s == nil || s.ID != "stop-1" {
+		t.Fatalf("got %+v but expected the terminating signal", s)
+	}
+	ack := receiveAck(t, acks)
+	if ack.SignalID != "pause-1" || ack.Result != ackResultIgnored || ack.Reason != "no script is running" {
+		t.Errorf("unexpected ack: %+v", ack)
+	}
+	ack = receiveAck(t, acks)
+	if ack.SignalID != "stop-1" || ack.Result != ackResultDelivered || len(ack.TargetPIDs) != 0 {
+		t.Errorf("unexpected ack: %+v", ack)
+	}
+	acker.Close()
+}
@@ -1,9 +1,16 @@
 package paramedic
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"math/rand"
+	"net/http"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -11,49 +18,358 @@ import (
 	"github.com/aws/aws-sdk-go/service/s3"
 )
 
-type SignalWatcher struct {
-	bucket   string
-	key      string
-	interval time.Duration
-	s3       S3
+const (
+	signalDeliveryTimeout = 5 * time.Second
+
+	signalFailureKeep      = "keep"      // keep polling silently
+	signalFailureWarn      = "warn"      // warn in the output
+	signalFailureTerminate = "terminate" // terminate the script as a dead-man's switch
+
+	// polling is faster for a while after the start or a signal, and slower for long runs
+	signalFastPeriod = 2 * time.Minute
+	signalSlowAfter  = 30 * time.Minute
+	signalJitter     = 0.2 // randomizes intervals by +-20% so that a fleet does not poll in lockstep
+)
+
+// signalChannel is a transport of signal objects, e.g. an S3 object or an SQS queue.
+type signalChannel interface {
+	// receive returns signal objects available now. If wait, it may block for
+	// a while until one arrives, e.g. by long polling, or until ctx is done.
+	receive(ctx context.Context, wait bool) ([]*signal, error)
 }
 
-type signal struct {
-	Signal int `json:"signal"` // signal sent to the process
+// SignalWatcher receives signal objects from a channel and delivers each of
+// them once if it is meant for the current run.
+type SignalWatcher struct {
+	channel  signalChannel
+	interval time.Duration // between receives
+
+	// signals for other runs or issued before startedAt are ignored
+	runID     string
+	startedAt time.Time
+
+	delivered    map[string]bool // identities of signals already delivered
+	pending      []*signal       // received but not checked yet
+	lastSignalAt time.Time
+	ch           chan *signal
+	doneCh       chan struct{} // closed when the polling goroutine exits
+	mutex        sync.Mutex
+
+	random func() float64 // for jitter, defaults to a source seeded by the start time
+
+	// failureAction is applied once polling fails failureThreshold times in a
+	// row (0 to disable). Warnings are written to out.
+	failureThreshold int
+	failureAction    string
+	failures         int
+	out              io.Writer
 }
 
-func (w *SignalWatcher) Start() chan *signal {
+// Start polls the channel until ctx is done and sends signals to be delivered
+// to the returned channel. Wait waits for the polling to stop.
+func (w *SignalWatcher) Start(ctx context.Context) chan *signal {
 	ch := make(chan *signal)
+	doneCh := make(chan struct{})
+	w.mutex.Lock()
+	w.ch = ch
+	w.doneCh = doneCh
+	w.mutex.Unlock()
+
 	go func() {
+		defer close(doneCh)
 		for {
-			time.Sleep(w.interval)
+			if len(w.pending) == 0 {
+				select {
+				case <-time.After(w.nextInterval(time.Now())):
+				case <-ctx.Done():
+					return
+				}
+			}
 
-			s, err := w.Once()
+			s, err := w.poll(ctx, true)
+			if ctx.Err() != nil {
+				return // the signals not delivered are not settled
+			}
 			if err != nil {
 				log.Printf("[ERROR] %v", err)
-				continue
+				s = w.failed(err)
+			} else {
+				w.succeeded()
 			}
 			if s == nil {
 				continue
 			}
 
-			log.Printf("[INFO] A signal object is found: %+v", s)
-			ch <- s
+			select {
+			case ch <- s:
+				s.settled()
+			case <-ctx.Done():
+				return
+			}
 		}
 	}()
 
 	return ch
 }
 
-func (w *SignalWatcher) Once() (*signal, error) {
+// Wait waits for the polling goroutine to exit once the context given to
+// Start is done, so that nothing is received nor written to out after that.
+func (w *SignalWatcher) Wait() {
+	w.mutex.Lock()
+	doneCh := w.doneCh
+	w.mutex.Unlock()
+	if doneCh != nil {
+		<-doneCh
+	}
+}
+
+// failed counts consecutive polling failures and applies the failure policy
+// once they reach the threshold. It returns a signal terminating the script
+// if the policy says so.
+func (w *SignalWatcher) failed(err error) *signal {
+	w.failures++
+	if w.failureThreshold <= 0 || w.failures != w.failureThreshold {
+		return nil
+	}
+	log.Printf("[WARN] Polling signals failed %d times in a row", w.failures)
+
+	switch w.failureAction {
+	case signalFailureWarn:
+		fmt.Fprintf(w.out, "[warning: polling signals failed %d times in a row: %s]\n", w.failures, err)
+	case signalFailureTerminate:
+		fmt.Fprintf(w.out, "[polling signals failed %d times in a row, terminating the script: %s]\n", w.failures, err)
+		return &signal{
+			Action:   signalActionEscalate,
+			number:   syscall.SIGTERM,
+			duration: defaultEscalationGrace,
+			identity: fmt.Sprintf("watcher failures at %s", time.Now().Format(time.RFC3339Nano)),
+		}
+	}
+	return nil
+}
+
+func (w *SignalWatcher) succeeded() {
+	if w.failureThreshold > 0 && w.failures >= w.failureThreshold && w.failureAction == signalFailureWarn {
+		fmt.Fprintf(w.out, "[polling signals recovered after %d failures]\n", w.failures)
+	}
+	w.failures = 0
+}
+
+// nextInterval returns the wait before the next receive: half of the interval
+// right after the start or a signal, three times of it for long runs, with jitter.
+func (w *SignalWatcher) nextInterval(now time.Time) time.Duration {
+	w.mutex.Lock()
+	since := w.startedAt
+	if w.lastSignalAt.After(since) {
+		since = w.lastSignalAt
+	}
+	w.mutex.Unlock()
+
+	d := w.interval
+	switch elapsed := now.Sub(since); {
+	case elapsed < signalFastPeriod:
+		d /= 2
+	case elapsed >= signalSlowAfter:
+		d *= 3
+	}
+
+	if w.random == nil {
+		// the global source is not seeded before Go 1.20, which would give
+		// every agent of a fleet the same jitter
+		w.random = rand.New(rand.NewSource(time.Now().UnixNano())).Float64
+	}
+	return d + time.Duration(float64(d)*signalJitter*(2*w.random()-1))
+}
+
+// poll returns a signal which has not been delivered yet. A signal object is
+// delivered once; a new ID or a new version of the object is needed to send it again.
+func (w *SignalWatcher) poll(ctx context.Context, wait bool) (*signal, error) {
+	if len(w.pending) == 0 {
+		signals, err := w.channel.receive(ctx, wait)
+		// signals received before the error are checked by the next poll
+		w.pending = signals
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for len(w.pending) > 0 {
+		s := w.pending[0]
+		w.pending = w.pending[1:]
+		if w.accept(s) {
+			return s, nil
+		}
+	}
+	return nil, nil
+}
+
+// accept reports whether s is to be delivered: not delivered yet and meant for the current run.
+func (w *SignalWatcher) accept(s *signal) bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.delivered == nil {
+		w.delivered = map[string]bool{}
+	}
+	if w.delivered[s.identity] {
+		log.Printf("[DEBUG] The signal object is already delivered: %s", s.identity)
+		s.settled()
+		return false
+	}
+	w.delivered[s.identity] = true
+
+	if reason := w.stale(s); reason != "" {
+		log.Printf("[INFO] Ignoring a signal object because %s: %+v", reason, s)
+		s.settled()
+		return false
+	}
+
+	log.Printf("[INFO] A signal object is found: %+v", s)
+	w.lastSignalAt = time.Now()
+	return true
+}
+
+// Deliver sends a signal received outside of the channel, e.g. from the
+// control socket, to the job in the same way as signals from the channel.
+func (w *SignalWatcher) Deliver(s *signal) error {
+	if !w.accept(s) {
+		return errors.New("the signal is already delivered or not meant for this run")
+	}
+
+	w.mutex.Lock()
+	ch := w.ch
+	w.mutex.Unlock()
+	if ch == nil {
+		return errors.New("the job has not started yet")
+	}
+
+	select {
+	case ch <- s:
+		return nil
+	case <-time.After(signalDeliveryTimeout):
+		return errors.New("the job is not accepting signals now")
+	}
+}
+
+// stale returns why s is not meant for the current run, or "" if it is.
+func (w *SignalWatcher) stale(s *signal) string {
+	if s.RunID != "" {
+		if s.RunID != w.runID {
+			return fmt.Sprintf("it is for run %s", s.RunID)
+		}
+		return ""
+	}
+
+	issuedAt := s.lastModified
+	if s.IssuedAt != nil {
+		issuedAt = *s.IssuedAt
+	}
+	if !issuedAt.IsZero() && issuedAt.Before(w.startedAt) {
+		return fmt.Sprintf("it was issued at %s before the agent started", issuedAt.Format(time.RFC3339))
+	}
+	return ""
+}
+
+// multiSignalChannel receives signal objects from several channels in turn,
+// e.g. the shared S3 object and a per-instance SQS queue. Only the last
+// channel may wait, and only while nothing has been received from the others.
+type multiSignalChannel []signalChannel
+
+func (m multiSignalChannel) receive(ctx context.Context, wait bool) ([]*signal, error) {
+	signals := []*signal{}
+	var err error
+	for i, c := range m {
+		if ctx.Err() != nil {
+			return signals, ctx.Err()
+		}
+		received, cerr := c.receive(ctx, wait && i == len(m)-1 && len(signals) == 0)
+		signals = append(signals, received...)
+		if err == nil {
+			err = cerr
+		}
+	}
+	return signals, err
+}
+
+// s3SignalChannel reads a signal object in S3.
+type s3SignalChannel struct {
+	bucket string
+	key    string // shared by all instances
+	s3     S3
+
+	// instanceKey is the per-instance signal key (optional). Both keys are read
+	// on every receive, so that a per-instance object does not hide a new
+	// shared one.
+	instanceKey string
+
+	cache map[string]cachedSignal // by key
+}
+
+// cachedSignal is the last signal read from a key, returned while the object is not modified.
+type cachedSignal struct {
+	etag   string
+	signal *signal
+}
+
+// receive returns the per-instance and the shared signal objects in the order
+// of precedence: the per-instance one comes first unless only the shared one
+// terminates the script, so that neither a per-instance pause nor resume
+// delays a fleet-wide stop. If reading a key fails, signals read from the
+// other key are returned with the error.
+func (c *s3SignalChannel) receive(ctx context.Context, wait bool) ([]*signal, error) {
+	var instance *signal
+	var err error
+	if c.instanceKey != "" {
+		instance, err = c.onceAt(c.instanceKey)
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	shared, serr := c.Once()
+	if err == nil {
+		err = serr
+	}
+
+	signals := []*signal{}
+	if instance != nil {
+		signals = append(signals, instance)
+	}
+	if shared != nil {
+		if instance != nil && shared.terminates() && !instance.terminates() {
+			signals = append([]*signal{shared}, signals...)
+		} else {
+			signals = append(signals, shared)
+		}
+	}
+	return signals, err
+}
+
+// Once returns the current shared signal object.
+func (c *s3SignalChannel) Once() (*signal, error) {
+	return c.onceAt(c.key)
+}
+
+func (c *s3SignalChannel) onceAt(key string) (*signal, error) {
 	input := &s3.GetObjectInput{
-		Bucket: aws.String(w.bucket),
-		Key:    aws.String(w.key),
+		Bucket: aws.String(c.bucket),
+		Key:    aws.String(key),
+	}
+	// A conditional GetObject costs a request per poll like HeadObject, and
+	// saves another one to fetch the object once it appears or changes.
+	cached, ok := c.cache[key]
+	if ok {
+		// the body is not transferred unless the object has changed
+		input.IfNoneMatch = aws.String(cached.etag)
 	}
 
-	log.Printf("[DEBUG] Checking a signal object at s3://%s/%s", w.bucket, w.key)
-	output, err := w.s3.GetObject(input)
+	log.Printf("[DEBUG] Checking a signal object at s3://%s/%s", c.bucket, key)
+	output, err := c.s3.GetObject(input)
 	if err != nil {
+		if ok && isNotModified(err) {
+			log.Println("[DEBUG] The signal object is not modified")
+			return cached.signal, nil
+		}
+		delete(c.cache, key)
 		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
 			log.Println("[DEBUG] A signal object is not found")
 			return nil, nil
@@ -66,11 +382,39 @@ func (w *SignalWatcher) Once() (*signal, error) {
 		return nil, err
 	}
 
-	s := signal{}
-	err = json.Unmarshal(data, &s)
+	s, err := parseSignalObject(data)
 	if err != nil {
 		return nil, err
 	}
+	s.lastModified = aws.TimeValue(output.LastModified)
+
+	switch {
+	case s.ID != "":
+		s.identity = "id:" + s.ID
+	case aws.StringValue(output.VersionId) != "":
+		s.identity = "version:" + aws.StringValue(output.VersionId)
+	case aws.StringValue(output.ETag) != "":
+		s.identity = "etag:" + aws.StringValue(output.ETag)
+	default:
+		s.identity = "body:" + string(data)
+	}
+	s.identity = key + " " + s.identity
 
-	return &s, nil
+	if etag := aws.StringValue(output.ETag); etag != "" {
+		if c.cache == nil {
+			c.cache = map[string]cachedSignal{}
+		}
+		c.cache[key] = cachedSignal{etag: etag, signal: s}
+	}
+	return s, nil
+}
+
+func isNotModified(err error) bool {
+	if rerr, ok := err.(awserr.RequestFailure); ok && rerr.StatusCode() == http.StatusNotModified {
+		return true
+	}
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "NotModified" {
+		return true
+	}
+	return false
 }
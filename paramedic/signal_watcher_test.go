@@ -1,10 +1,16 @@
 package paramedic
 
 import (
+	"bytes"
+	"context"
+	"fmt"
 	"strings"
+	"syscall"
 	"testing"
 	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/golang/mock/gomock"
 	"github.com/ryotarai/paramedic-agent/mock"
@@ -28,18 +34,481 @@ func TestSignalWatcherOnce(t *testing.T) {
 		Body: body,
 	}, nil)
 
+	c := &s3SignalChannel{
+		bucket: "paramedic",
+		key:    "signal/a.json",
+		s3:     s3m,
+	}
+
+	sig, err := c.Once()
+	if err != nil {
+		t.Error(err)
+	}
+	if sig.number != 15 {
+		t.Errorf("signal is %d but expected %d", sig.number, 15)
+	}
+}
+
+func TestSignalWatcherPoll(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	s3m := mock.NewMockS3(mockCtrl)
+
+	objects := []struct {
+		body string
+		etag string
+	}{
+		{`{"signal": 15}`, `"a"`},
+		{`{"signal": 15}`, `"a"`}, // same object
+		{`{"signal": 15}`, `"b"`}, // overwritten
+		{`{"signal": 9, "id": "kill"}`, `"c"`},
+		{`{"signal": 9, "id": "kill"}`, `"d"`}, // same ID
+	}
+	calls := []*gomock.Call{}
+	for _, o := range objects {
+		calls = append(calls, s3m.EXPECT().GetObject(gomock.Any()).Return(&s3.GetObjectOutput{
+			Body: &stringReadCloser{strings.NewReader(o.body)},
+			ETag: aws.String(o.etag),
+		}, nil))
+	}
+	gomock.InOrder(calls...)
+
 	w := &SignalWatcher{
-		bucket:   "paramedic",
-		key:      "signal/a.json",
+		channel: &s3SignalChannel{
+			bucket: "paramedic",
+			key:    "signal/a.json",
+			s3:     s3m,
+		},
 		interval: 100 * time.Millisecond,
-		s3:       s3m,
 	}
 
-	sig, err := w.Once()
+	expected := []int{15, 0, 15, 9, 0}
+	for i, e := range expected {
+		sig, err := w.poll(context.Background(), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := 0
+		if sig != nil {
+			got = int(sig.number)
+		}
+		if got != e {
+			t.Errorf("poll %d: got signal %d but expected %d", i+1, got, e)
+		}
+	}
+}
+
+func TestSignalWatcherPollIgnoresStaleSignals(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	s3m := mock.NewMockS3(mockCtrl)
+
+	startedAt := time.Date(2017, 9, 1, 12, 0, 0, 0, time.UTC)
+	before := startedAt.Add(-time.Hour)
+	after := startedAt.Add(time.Minute)
+
+	objects := []struct {
+		body         string
+		lastModified time.Time
+		signal       int
+	}{
+		{`{"signal": 15, "runId": "run-2"}`, after, 0},
+		{`{"signal": 15}`, before, 0},
+		{`{"signal": 15, "issuedAt": "2017-09-01T11:00:00Z"}`, after, 0},
+		{`{"signal": 15, "runId": "run-1"}`, before, 15},
+		{`{"signal": 9, "issuedAt": "2017-09-01T12:05:00Z"}`, before, 9},
+		{`{"signal": 2}`, after, 2},
+	}
+	calls := []*gomock.Call{}
+	for i, o := range objects {
+		calls = append(calls, s3m.EXPECT().GetObject(gomock.Any()).Return(&s3.GetObjectOutput{
+			Body:         &stringReadCloser{strings.NewReader(o.body)},
+			ETag:         aws.String(fmt.Sprintf("%d", i)),
+			LastModified: aws.Time(o.lastModified),
+		}, nil))
+	}
+	gomock.InOrder(calls...)
+
+	w := &SignalWatcher{
+		channel: &s3SignalChannel{
+			bucket: "paramedic",
+			key:    "signal/a.json",
+			s3:     s3m,
+		},
+		interval:  100 * time.Millisecond,
+		runID:     "run-1",
+		startedAt: startedAt,
+	}
+
+	for _, o := range objects {
+		sig, err := w.poll(context.Background(), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := 0
+		if sig != nil {
+			got = int(sig.number)
+		}
+		if got != o.signal {
+			t.Errorf("%s: got signal %d but expected %d", o.body, got, o.signal)
+		}
+	}
+}
+
+func TestS3SignalChannelReceiveBothKeys(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	s3m := mock.NewMockS3(mockCtrl)
+
+	instanceInput := &s3.GetObjectInput{
+		Bucket: aws.String("paramedic"),
+		Key:    aws.String("signal/i-0123.json"),
+	}
+	instanceConditional := &s3.GetObjectInput{
+		Bucket:      aws.String("paramedic"),
+		Key:         aws.String("signal/i-0123.json"),
+		IfNoneMatch: aws.String(`"p"`),
+	}
+	sharedInput := &s3.GetObjectInput{
+		Bucket: aws.String("paramedic"),
+		Key:    aws.String("signal/a.json"),
+	}
+	notModified := awserr.NewRequestFailure(awserr.New("NotModified", "Not Modified", nil), 304, "request-id")
+	gomock.InOrder(
+		// a per-instance pause is delivered
+		s3m.EXPECT().GetObject(instanceInput).Return(&s3.GetObjectOutput{
+			Body: &stringReadCloser{strings.NewReader(`{"version": 2, "id": "pause-1", "action": "pause"}`)},
+			ETag: aws.String(`"p"`),
+		}, nil),
+		s3m.EXPECT().GetObject(sharedInput).Return(nil, awserr.New(s3.ErrCodeNoSuchKey, "not found", nil)),
+		// the pause is left in place and a fleet-wide TERM arrives
+		s3m.EXPECT().GetObject(instanceConditional).Return(nil, notModified),
+		s3m.EXPECT().GetObject(sharedInput).Return(&s3.GetObjectOutput{
+			Body: &stringReadCloser{strings.NewReader(`{"version": 2, "id": "stop-1", "signal": "TERM"}`)},
+		}, nil),
+	)
+
+	w := &SignalWatcher{
+		channel: &s3SignalChannel{
+			bucket:      "paramedic",
+			key:         "signal/a.json",
+			instanceKey: "signal/i-0123.json",
+			s3:          s3m,
+		},
+	}
+
+	expected := []string{signalActionPause, signalActionSignal}
+	for _, e := range expected {
+		sig, err := w.poll(context.Background(), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sig == nil || sig.Action != e {
+			t.Fatalf("got %+v but expected %s", sig, e)
+		}
+	}
+}
+
+func TestS3SignalChannelReceivePrecedence(t *testing.T) {
+	cases := []struct {
+		instance string
+		shared   string
+		expected []string
+	}{
+		{`{"version": 2, "action": "pause"}`, `{"version": 2, "signal": "TERM"}`, []string{signalActionSignal, signalActionPause}},
+		{`{"version": 2, "action": "kill-tree"}`, `{"version": 2, "action": "dump-diagnostics"}`, []string{signalActionKillTree, signalActionDumpDiagnostics}},
+		{`{"version": 2, "action": "escalate"}`, `{"version": 2, "signal": "TERM"}`, []string{signalActionEscalate, signalActionSignal}},
+	}
+	for _, c := range cases {
+		mockCtrl := gomock.NewController(t)
+		s3m := mock.NewMockS3(mockCtrl)
+		gomock.InOrder(
+			s3m.EXPECT().GetObject(gomock.Any()).Return(&s3.GetObjectOutput{
+				Body: &stringReadCloser{strings.NewReader(c.instance)},
+			}, nil),
+			s3m.EXPECT().GetObject(gomock.Any()).Return(&s3.GetObjectOutput{
+				Body: &stringReadCloser{strings.NewReader(c.shared)},
+			}, nil),
+		)
+
+		ch := &s3SignalChannel{
+			bucket:      "paramedic",
+			key:         "signal/a.json",
+			instanceKey: "signal/i-0123.json",
+			s3:          s3m,
+		}
+		signals, err := ch.receive(context.Background(), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actions := []string{}
+		for _, s := range signals {
+			actions = append(actions, s.Action)
+		}
+		if strings.Join(actions, ",") != strings.Join(c.expected, ",") {
+			t.Errorf("got %v but expected %v", actions, c.expected)
+		}
+		mockCtrl.Finish()
+	}
+}
+
+func TestS3SignalChannelConditionalGet(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	s3m := mock.NewMockS3(mockCtrl)
+
+	input := &s3.GetObjectInput{
+		Bucket: aws.String("paramedic"),
+		Key:    aws.String("signal/a.json"),
+	}
+	conditional := &s3.GetObjectInput{
+		Bucket:      aws.String("paramedic"),
+		Key:         aws.String("signal/a.json"),
+		IfNoneMatch: aws.String(`"a"`),
+	}
+	notModified := awserr.NewRequestFailure(awserr.New("NotModified", "Not Modified", nil), 304, "request-id")
+	gomock.InOrder(
+		s3m.EXPECT().GetObject(input).Return(&s3.GetObjectOutput{
+			Body: &stringReadCloser{strings.NewReader(`{"signal": 15}`)},
+			ETag: aws.String(`"a"`),
+		}, nil),
+		s3m.EXPECT().GetObject(conditional).Return(nil, notModified),
+		s3m.EXPECT().GetObject(conditional).Return(nil, awserr.New(s3.ErrCodeNoSuchKey, "not found", nil)),
+		s3m.EXPECT().GetObject(input).Return(nil, awserr.New(s3.ErrCodeNoSuchKey, "not found", nil)),
+	)
+
+	w := &SignalWatcher{
+		channel: &s3SignalChannel{
+			bucket: "paramedic",
+			key:    "signal/a.json",
+			s3:     s3m,
+		},
+	}
+
+	expected := []int{15, 0, 0, 0}
+	for i, e := range expected {
+		sig, err := w.poll(context.Background(), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := 0
+		if sig != nil {
+			got = int(sig.number)
+		}
+		if got != e {
+			t.Errorf("poll %d: got signal %d but expected %d", i+1, got, e)
+		}
+	}
+}
+
+func TestSignalWatcherNextInterval(t *testing.T) {
+	startedAt := time.Date(2017, 9, 1, 12, 0, 0, 0, time.UTC)
+	w := &SignalWatcher{
+		interval:  10 * time.Second,
+		startedAt: startedAt,
+		random:    func() float64 { return 0.5 }, // no jitter
+	}
+
+	cases := []struct {
+		elapsed  time.Duration
+		expected time.Duration
+	}{
+		{10 * time.Second, 5 * time.Second},
+		{10 * time.Minute, 10 * time.Second},
+		{time.Hour, 30 * time.Second},
+	}
+	for _, c := range cases {
+		if d := w.nextInterval(startedAt.Add(c.elapsed)); d != c.expected {
+			t.Errorf("after %s: got %s but expected %s", c.elapsed, d, c.expected)
+		}
+	}
+
+	// fast again once a signal is seen
+	w.lastSignalAt = startedAt.Add(time.Hour)
+	if d := w.nextInterval(startedAt.Add(time.Hour + time.Minute)); d != 5*time.Second {
+		t.Errorf("got %s but expected %s after a signal", d, 5*time.Second)
+	}
+
+	w.random = func() float64 { return 1 }
+	if d := w.nextInterval(startedAt.Add(time.Hour + 10*time.Minute)); d != 12*time.Second {
+		t.Errorf("got %s but expected %s with the max jitter", d, 12*time.Second)
+	}
+}
+
+func TestSignalWatcherNextInterval_Seeded(t *testing.T) {
+	startedAt := time.Now()
+	intervals := map[time.Duration]bool{}
+	for i := 0; i < 5; i++ {
+		w := &SignalWatcher{interval: 10 * time.Minute, startedAt: startedAt}
+		d := w.nextInterval(startedAt)
+		if d < 4*time.Minute || d > 6*time.Minute {
+			t.Errorf("got %s but expected 5m with 20%% jitter", d)
+		}
+		intervals[d] = true
+		time.Sleep(time.Millisecond)
+	}
+	if len(intervals) == 1 {
+		t.Errorf("watchers got the same jitter; the random source should be seeded for each")
+	}
+}
+
+type failingSignalChannel struct {
+	calls int
+}
+
+func (c *failingSignalChannel) receive(ctx context.Context, wait bool) ([]*signal, error) {
+	c.calls++
+	return nil, fmt.Errorf("access denied (%d)", c.calls)
+}
+
+func TestSignalWatcherTerminatesOnFailures(t *testing.T) {
+	out := &bytes.Buffer{}
+	w := &SignalWatcher{
+		channel:          &failingSignalChannel{},
+		interval:         time.Millisecond,
+		failureThreshold: 3,
+		failureAction:    signalFailureTerminate,
+		out:              out,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := w.Start(ctx)
+
+	select {
+	case s := <-ch:
+		if s.Action != signalActionEscalate || s.number != syscall.SIGTERM {
+			t.Errorf("got %+v but expected escalation", s)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the script is not terminated")
+	}
+	if !strings.Contains(out.String(), "failed 3 times in a row") {
+		t.Errorf("unexpected output: %s", out.String())
+	}
+}
+
+// flakySignalChannel fails the first failures receives, then returns signals
+// once. done is closed after calls receives.
+type flakySignalChannel struct {
+	failures int
+	signals  []*signal
+	calls    int
+	stopAt   int
+	done     chan struct{}
+}
+
+func (c *flakySignalChannel) receive(ctx context.Context, wait bool) ([]*signal, error) {
+	c.calls++
+	if c.calls == c.stopAt {
+		close(c.done)
+	}
+	if c.calls <= c.failures {
+		return nil, fmt.Errorf("access denied (%d)", c.calls)
+	}
+	signals := c.signals
+	c.signals = nil
+	return signals, nil
+}
+
+func TestSignalWatcherFailureActions(t *testing.T) {
+	cases := []struct {
+		action   string
+		expected []string
+	}{
+		{signalFailureWarn, []string{
+			"[warning: polling signals failed 2 times in a row: access denied (2)]\n",
+			"[polling signals recovered after 3 failures]\n",
+		}},
+		{signalFailureKeep, nil},
+	}
+	for _, c := range cases {
+		out := &bytes.Buffer{}
+		channel := &flakySignalChannel{failures: 3, stopAt: 5, done: make(chan struct{})}
+		w := &SignalWatcher{
+			channel:          channel,
+			interval:         time.Millisecond,
+			failureThreshold: 2,
+			failureAction:    c.action,
+			out:              out,
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		w.Start(ctx)
+		select {
+		case <-channel.done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: the watcher stopped polling", c.action)
+		}
+		cancel()
+		w.Wait()
+
+		if out.String() != strings.Join(c.expected, "") {
+			t.Errorf("%s: unexpected output: %q", c.action, out.String())
+		}
+	}
+}
+
+func TestSignalWatcherStopsWithPendingSignal(t *testing.T) {
+	settled := false
+	s := &signal{Action: signalActionSignal, number: syscall.SIGTERM, identity: "sig"}
+	s.settle = func() { settled = true }
+	w := &SignalWatcher{
+		channel:  &flakySignalChannel{signals: []*signal{s}},
+		interval: time.Millisecond,
+	}
+
+	// nobody receives the signal
+	ctx, cancel := context.WithCancel(context.Background())
+	w.Start(ctx)
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	done := make(chan struct{})
+	go func() {
+		w.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the watcher did not stop")
+	}
+	if settled {
+		t.Errorf("the signal should not be settled since it is not delivered")
+	}
+}
+
+// recordingSignalChannel returns signals once and records whether each receive may wait.
+type recordingSignalChannel struct {
+	signals []*signal
+	waits   []bool
+}
+
+func (c *recordingSignalChannel) receive(ctx context.Context, wait bool) ([]*signal, error) {
+	c.waits = append(c.waits, wait)
+	signals := c.signals
+	c.signals = nil
+	return signals, nil
+}
+
+func TestMultiSignalChannel(t *testing.T) {
+	shared := &recordingSignalChannel{signals: []*signal{{Action: signalActionSignal, identity: "shared"}}}
+	queue := &recordingSignalChannel{signals: []*signal{{Action: signalActionPause, identity: "queue"}}}
+	m := multiSignalChannel{shared, queue}
+
+	signals, err := m.receive(context.Background(), true)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
+	}
+	if len(signals) != 2 || signals[0].identity != "shared" || signals[1].identity != "queue" {
+		t.Errorf("got %+v but expected signals of both channels", signals)
+	}
+	// the queue does not wait while a signal from the shared object is pending
+	if _, err := m.receive(context.Background(), true); err != nil {
+		t.Fatal(err)
 	}
-	if sig.Signal != 15 {
-		t.Errorf("signal is %d but expected %d", sig.Signal, 15)
+	if fmt.Sprint(shared.waits) != "[false false]" || fmt.Sprint(queue.waits) != "[false true]" {
+		t.Errorf("got waits %v and %v but expected only the queue to wait when nothing is received", shared.waits, queue.waits)
 	}
 }
@@ -0,0 +1,163 @@
+package paramedic
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	phaseStarted        = "started"
+	phaseDownloaded     = "downloaded"
+	phaseRunning        = "running"
+	phaseSignalReceived = "signal-received"
+	phaseExited         = "exited"
+	phaseLogsFlushed    = "logs-flushed"
+	phaseFailed         = "failed" // the agent failed before or after running the script
+)
+
+type phaseTransition struct {
+	Phase string    `json:"phase"`
+	At    time.Time `json:"at"`
+}
+
+type instanceStatus struct {
+	InstanceID string            `json:"instanceId"`
+	RunID      string            `json:"runId"`
+	Phase      string            `json:"phase"`
+	PID        int               `json:"pid,omitempty"`
+	Signal     int               `json:"signal,omitempty"` // last signal received from the signal object
+	Action     string            `json:"action,omitempty"` // action of the last signal object
+	ExitStatus *int              `json:"exitStatus,omitempty"`
+	Error      string            `json:"error,omitempty"` // error of the agent itself
+	UpdatedAt  time.Time         `json:"updatedAt"`
+	Phases     []phaseTransition `json:"phases"`
+}
+
+// StatusReporter keeps a status object of an instance in S3 up to date.
+// The object is uploaded in background so that a slow S3 does not delay the
+// job; only the latest status is uploaded. Without a bucket, the status is
+// only kept in memory, e.g. for the control socket. All methods are no-op on
+// a nil StatusReporter.
+type StatusReporter struct {
+	s3      S3
+	bucket  string
+	key     string
+	status  instanceStatus
+	mutex   sync.Mutex
+	dirty   bool
+	started bool
+
+	updateCh chan struct{}
+	closeCh  chan struct{}
+	doneCh   chan struct{}
+}
+
+func NewStatusReporter(s3 S3, bucket string, key string, instanceID string, runID string) *StatusReporter {
+	return &StatusReporter{
+		s3:     s3,
+		bucket: bucket,
+		key:    key,
+		status: instanceStatus{
+			InstanceID: instanceID,
+			RunID:      runID,
+			Phases:     []phaseTransition{},
+		},
+		mutex: sync.Mutex{},
+
+		updateCh: make(chan struct{}, 1),
+		closeCh:  make(chan struct{}),
+		doneCh:   make(chan struct{}),
+	}
+}
+
+func (r *StatusReporter) Start() {
+	if r == nil || r.bucket == "" {
+		return
+	}
+	r.started = true
+
+	go func() {
+		defer close(r.doneCh)
+		for {
+			select {
+			case <-r.updateCh:
+				r.upload()
+			case <-r.closeCh:
+				r.upload()
+				return
+			}
+		}
+	}()
+}
+
+// Close uploads the last status if it is not uploaded yet.
+func (r *StatusReporter) Close() {
+	if r == nil || !r.started {
+		return
+	}
+	close(r.closeCh)
+	<-r.doneCh
+}
+
+// Update moves the status to phase, applies f (if any) and uploads the status object.
+func (r *StatusReporter) Update(phase string, f func(s *instanceStatus)) {
+	if r == nil {
+		return
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := time.Now()
+	r.status.Phase = phase
+	r.status.UpdatedAt = now
+	r.status.Phases = append(r.status.Phases, phaseTransition{Phase: phase, At: now})
+	if f != nil {
+		f(&r.status)
+	}
+	r.dirty = true
+
+	select {
+	case r.updateCh <- struct{}{}:
+	default: // an upload is already pending
+	}
+}
+
+// Fail moves the status to the failed phase with the error of the agent.
+func (r *StatusReporter) Fail(err error) {
+	r.Update(phaseFailed, func(s *instanceStatus) {
+		s.Error = err.Error()
+	})
+}
+
+func (r *StatusReporter) upload() {
+	r.mutex.Lock()
+	if !r.dirty {
+		r.mutex.Unlock()
+		return
+	}
+	r.dirty = false
+	status := r.status
+	status.Phases = append([]phaseTransition{}, r.status.Phases...)
+	r.mutex.Unlock()
+
+	log.Printf("[DEBUG] Updating a status object at s3://%s/%s (phase: %s)", r.bucket, r.key, status.Phase)
+	if err := putJSONObject(r.s3, r.bucket, r.key, &status); err != nil {
+		log.Printf("[WARN] Failed to update a status object: %s", err)
+	}
+}
+
+// Snapshot returns a copy of the current status.
+func (r *StatusReporter) Snapshot() instanceStatus {
+	if r == nil {
+		return instanceStatus{}
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	s := r.status
+	s.Phases = append([]phaseTransition{}, r.status.Phases...)
+	return s
+}
@@ -0,0 +1,116 @@
+package paramedic
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/golang/mock/gomock"
+	"github.com/ryotarai/paramedic-agent/mock"
+)
+
+// recordStatuses records status objects uploaded through s3m, blocking each
+// upload until release is closed.
+func recordStatuses(t *testing.T, s3m *mock.MockS3, release chan struct{}) func() []instanceStatus {
+	mutex := sync.Mutex{}
+	uploaded := []instanceStatus{}
+	s3m.EXPECT().PutObject(gomock.Any()).AnyTimes().Do(func(input *s3.PutObjectInput) {
+		<-release
+		if aws.StringValue(input.Key) != "status/i-123.json" {
+			t.Errorf("got key %s", aws.StringValue(input.Key))
+		}
+		s := instanceStatus{}
+		if err := json.NewDecoder(input.Body).Decode(&s); err != nil {
+			t.Fatal(err)
+		}
+		mutex.Lock()
+		uploaded = append(uploaded, s)
+		mutex.Unlock()
+	}).Return(&s3.PutObjectOutput{}, nil)
+
+	return func() []instanceStatus {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return uploaded
+	}
+}
+
+func TestStatusReporter_UpdateDoesNotWaitForUpload(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	s3m := mock.NewMockS3(mockCtrl)
+
+	release := make(chan struct{})
+	uploaded := recordStatuses(t, s3m, release)
+
+	r := NewStatusReporter(s3m, "b", "status/i-123.json", "i-123", "run-1")
+	r.Start()
+
+	done := make(chan struct{})
+	go func() {
+		r.Update(phaseStarted, nil)
+		r.Update(phaseDownloaded, nil)
+		r.Update(phaseRunning, func(s *instanceStatus) { s.PID = 42 })
+		r.Update(phaseExited, func(s *instanceStatus) { s.ExitStatus = aws.Int(0) })
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Update is blocked by the upload")
+	}
+
+	close(release)
+	r.Close()
+
+	statuses := uploaded()
+	if len(statuses) == 0 || len(statuses) > 4 {
+		t.Fatalf("got %d uploads", len(statuses))
+	}
+	last := statuses[len(statuses)-1]
+	if last.Phase != phaseExited || last.PID != 42 || last.ExitStatus == nil || len(last.Phases) != 4 {
+		t.Errorf("got %+v as the last status", last)
+	}
+}
+
+func TestStatusReporter_Fail(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	s3m := mock.NewMockS3(mockCtrl)
+
+	release := make(chan struct{})
+	close(release)
+	uploaded := recordStatuses(t, s3m, release)
+
+	r := NewStatusReporter(s3m, "b", "status/i-123.json", "i-123", "run-1")
+	r.Start()
+	r.Update(phaseStarted, nil)
+	r.Fail(errors.New("manifest not found"))
+	r.Close()
+
+	statuses := uploaded()
+	last := statuses[len(statuses)-1]
+	if last.Phase != phaseFailed || last.Error != "manifest not found" || last.RunID != "run-1" {
+		t.Errorf("got %+v as the last status", last)
+	}
+}
+
+func TestStatusReporter_WithoutBucket(t *testing.T) {
+	r := NewStatusReporter(nil, "", "", "i-123", "run-1")
+	r.Start()
+	r.Update(phaseStarted, nil)
+	r.Close()
+
+	if s := r.Snapshot(); s.Phase != phaseStarted || s.InstanceID != "i-123" {
+		t.Errorf("got %+v", s)
+	}
+
+	var nilReporter *StatusReporter
+	nilReporter.Start()
+	nilReporter.Fail(errors.New("ignored"))
+	nilReporter.Close()
+}
@@ -0,0 +1,273 @@
+package paramedic
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+const (
+	onFailureAbort    = "abort"
+	onFailureContinue = "continue"
+	onFailureRun      = "run"
+)
+
+// Step is a script run as a part of a multi-step job.
+type Step struct {
+	Name           string        `yaml:"Name"`
+	ScriptS3Bucket string        `yaml:"ScriptS3Bucket"` // defaults to -script-s3-bucket
+	ScriptS3Key    string        `yaml:"ScriptS3Key"`
+	Timeout        time.Duration `yaml:"Timeout"` // no timeout by default
+	Retry          RetryPolicy   `yaml:"Retry"`
+	// OnFailure is one of "abort" (default), "continue" and "run <step>".
+	// "run <step>" jumps to a later step, e.g. cleanup, and proceeds from there.
+	OnFailure string `yaml:"OnFailure"`
+	// Always runs the step even if an earlier step aborted the job or jumped over it.
+	Always bool `yaml:"Always"`
+
+	// Parallel makes the step a group of steps run concurrently instead of a script.
+	Parallel       []Step `yaml:"Parallel"`
+	MaxParallelism int    `yaml:"MaxParallelism"` // defaults to the number of steps in the group
+	// SeparateLogStreams writes the output of each step in the group to
+	// "<log stream>/<step name>" instead of prefixing lines with the step name.
+	SeparateLogStreams bool `yaml:"SeparateLogStreams"`
+}
+
+type stepResult struct {
+	Name           string          `json:"name"`
+	ScriptLocation string          `json:"scriptLocation"`
+	ScriptVersion  string          `json:"scriptVersion,omitempty"`
+	StartedAt      time.Time       `json:"startedAt"`
+	FinishedAt     time.Time       `json:"finishedAt"`
+	ExitStatus     *int            `json:"exitStatus"`
+	Signal         *int            `json:"signal"`
+	TimedOut       bool            `json:"timedOut"`
+	Attempts       []attemptResult `json:"attempts,omitempty"`
+	Steps          []stepResult    `json:"steps,omitempty"` // steps in a parallel group
+	Error          string          `json:"error,omitempty"` // why the agent failed to run the step
+}
+
+// onFailure returns the action and the target step of "run <step>".
+func (s Step) onFailure() (string, string) {
+	fields := strings.Fields(s.OnFailure)
+	if len(fields) == 0 {
+		return onFailureAbort, ""
+	}
+	if fields[0] == onFailureRun && len(fields) == 2 {
+		return onFailureRun, fields[1]
+	}
+	return fields[0], ""
+}
+
+func validateSteps(steps []Step) error {
+	index := map[string]int{}
+	names := map[string]bool{} // including steps in groups
+	for i, s := range steps {
+		if s.Name == "" {
+			return fmt.Errorf("Name of step %d is mandatory", i+1)
+		}
+		if names[s.Name] {
+			return fmt.Errorf("step %s is defined twice", s.Name)
+		}
+		names[s.Name] = true
+		index[s.Name] = i
+
+		if len(s.Parallel) == 0 {
+			if s.ScriptS3Key == "" {
+				return fmt.Errorf("ScriptS3Key of step %s is mandatory", s.Name)
+			}
+			continue
+		}
+
+		if s.ScriptS3Key != "" {
+			return fmt.Errorf("step %s cannot have both ScriptS3Key and Parallel", s.Name)
+		}
+		for j, p := range s.Parallel {
+			if p.Name == "" {
+				return fmt.Errorf("Name of step %d in %s is mandatory", j+1, s.Name)
+			}
+			if names[p.Name] {
+				return fmt.Errorf("step %s is defined twice", p.Name)
+			}
+			names[p.Name] = true
+			if p.ScriptS3Key == "" || len(p.Parallel) > 0 {
+				return fmt.Errorf("ScriptS3Key of step %s is mandatory (groups cannot be nested)", p.Name)
+			}
+			if action, _ := p.onFailure(); action != onFailureAbort && action != onFailureContinue {
+				return fmt.Errorf("OnFailure of step %s in a group must be 'abort' or 'continue'", p.Name)
+			}
+			if p.Always {
+				return fmt.Errorf("step %s in a group cannot be Always (set it to the group)", p.Name)
+			}
+		}
+	}
+
+	for i, s := range steps {
+		action, target := s.onFailure()
+		switch action {
+		case onFailureAbort, onFailureContinue:
+		case onFailureRun:
+			j, ok := index[target]
+			if !ok {
+				return fmt.Errorf("OnFailure of step %s refers to unknown step %s", s.Name, target)
+			}
+			if j <= i {
+				return fmt.Errorf("OnFailure of step %s must refer to a later step", s.Name)
+			}
+		default:
+			return fmt.Errorf("invalid OnFailure of step %s: %s", s.Name, s.OnFailure)
+		}
+	}
+	return nil
+}
+
+func stepIndex(steps []Step, name string) int {
+	for i, s := range steps {
+		if s.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+type stepOutcome struct {
+	result     stepResult
+	exitStatus int
+	exitErr    error
+}
+
+// agentFailure is the outcome of a step which the agent failed to run, e.g.
+// because its script cannot be downloaded.
+func agentFailure(s Step, err error) *stepOutcome {
+	return &stepOutcome{
+		result:     stepResult{Name: s.Name, StartedAt: time.Now(), FinishedAt: time.Now(), Error: err.Error()},
+		exitStatus: errorExitStatus,
+		exitErr:    err,
+	}
+}
+
+type stepsRun struct {
+	steps      []stepResult
+	exitStatus int
+	exitErr    error
+}
+
+// runSteps runs steps in order following their failure policies. Steps
+// skipped by a failure still run if they are Always. The exit status of the
+// job is that of the first failed step which is not "continue". A step which
+// the agent fails to run fails with errorExitStatus, and the first of such
+// errors is returned once all steps to run have finished.
+func (r *jobRunner) runSteps(steps []Step, defaultBucket string) (*stepsRun, error) {
+	job := &stepsRun{
+		steps: []stepResult{},
+	}
+	var agentErr error
+	failed := false
+	resumeAt := 0 // steps before it are skipped unless they are Always
+
+	for i := 0; i < len(steps); i++ {
+		s := steps[i]
+		if i < resumeAt && !s.Always {
+			continue
+		}
+		if r.shutdown.isSet() {
+			for _, s := range steps[i:] {
+				fmt.Fprintf(r.out, "[step %s skipped: %s]\n", s.Name, errAgentShuttingDown)
+			}
+			if !failed {
+				failed = true
+				job.exitStatus, job.exitErr = errorExitStatus, errAgentShuttingDown
+			}
+			break
+		}
+		log.Printf("[INFO] Starting step %s", s.Name)
+		fmt.Fprintf(r.out, "[step %s: started]\n", s.Name)
+
+		var o *stepOutcome
+		var err error
+		if len(s.Parallel) > 0 {
+			o, err = r.runGroup(s, defaultBucket)
+		} else {
+			o, err = r.runStep(s, defaultBucket)
+		}
+		if err != nil && err != errAgentShuttingDown {
+			log.Printf("[ERROR] Failed to run step %s: %s", s.Name, err)
+			if agentErr == nil {
+				agentErr = err
+			}
+		}
+		if o == nil {
+			o = agentFailure(s, err)
+		}
+		job.steps = append(job.steps, o.result)
+		exitStatus, exitErr := o.exitStatus, o.exitErr
+
+		if exitErr == nil {
+			fmt.Fprintf(r.out, "[step %s: exit status %d]\n", s.Name, exitStatus)
+		} else {
+			fmt.Fprintf(r.out, "[step %s: %s]\n", s.Name, exitErr)
+		}
+
+		if exitErr == nil && exitStatus == 0 {
+			continue
+		}
+
+		action, target := s.onFailure()
+		if action != onFailureContinue && !failed {
+			failed = true
+			job.exitStatus, job.exitErr = exitStatus, exitErr
+		}
+		switch action {
+		case onFailureContinue:
+		case onFailureRun:
+			fmt.Fprintf(r.out, "[step %s failed, running step %s]\n", s.Name, target)
+			if j := stepIndex(steps, target); j > resumeAt {
+				resumeAt = j
+			}
+		default:
+			fmt.Fprintf(r.out, "[step %s failed, aborting]\n", s.Name)
+			resumeAt = len(steps)
+		}
+	}
+
+	for _, sr := range job.steps {
+		status := "-"
+		if sr.ExitStatus != nil {
+			status = fmt.Sprintf("%d", *sr.ExitStatus)
+		}
+		fmt.Fprintf(r.out, "[summary: step %s exit status %s]\n", sr.Name, status)
+	}
+
+	return job, agentErr
+}
+
+// runStep runs the script of a step. It returns an error only if the agent fails to run it.
+func (r *jobRunner) runStep(s Step, defaultBucket string) (*stepOutcome, error) {
+	bucket := s.ScriptS3Bucket
+	if bucket == "" {
+		bucket = defaultBucket
+	}
+	sr := stepResult{
+		Name:           s.Name,
+		ScriptLocation: fmt.Sprintf("s3://%s/%s", bucket, s.ScriptS3Key),
+		StartedAt:      time.Now(),
+	}
+
+	run, err := r.runScript(bucket, s.ScriptS3Key, s.Timeout, s.Retry, false)
+	if err != nil {
+		return nil, err
+	}
+	sr.FinishedAt = time.Now()
+	sr.ScriptVersion = run.version
+	sr.ExitStatus = run.last.ExitStatus
+	sr.Signal = run.last.Signal
+	sr.TimedOut = run.last.TimedOut
+	sr.Attempts = run.attempts
+
+	return &stepOutcome{
+		result:     sr,
+		exitStatus: run.exitStatus,
+		exitErr:    run.exitErr,
+	}, nil
+}
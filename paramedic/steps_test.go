@@ -0,0 +1,356 @@
+package paramedic
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/golang/mock/gomock"
+	"github.com/ryotarai/paramedic-agent/mock"
+)
+
+func TestJobRunner_RunSteps(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	s3m := mock.NewMockS3(mockCtrl)
+
+	scripts := map[string]string{
+		"drain":   "#!/bin/sh\necho draining\n",
+		"fix":     "#!/bin/sh\necho fixing\nexit 3\n",
+		"verify":  "#!/bin/sh\necho verifying\n",
+		"undrain": "#!/bin/sh\necho undraining\n",
+	}
+	for _, key := range []string{"drain", "fix", "undrain"} {
+		body := &stringReadCloser{strings.NewReader(scripts[key])}
+		s3m.EXPECT().GetObject(&s3.GetObjectInput{
+			Bucket: aws.String("b"),
+			Key:    aws.String(key),
+		}).Return(&s3.GetObjectOutput{Body: body}, nil)
+	}
+
+	steps := []Step{
+		{Name: "drain", ScriptS3Key: "drain"},
+		{Name: "fix", ScriptS3Key: "fix", OnFailure: "run undrain"},
+		{Name: "verify", ScriptS3Key: "verify"},
+		{Name: "undrain", ScriptS3Key: "undrain"},
+	}
+	if err := validateSteps(steps); err != nil {
+		t.Fatal(err)
+	}
+
+	out := &bytes.Buffer{}
+	r := &jobRunner{
+		clients:    &awsClients{s3: s3m},
+		out:        out,
+		stdout:     out,
+		stderr:     out,
+		inheritEnv: "all",
+	}
+	job, err := r.runSteps(steps, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if job.exitStatus != 3 || job.exitErr != nil {
+		t.Errorf("got exit status %d (%v) but expected %d", job.exitStatus, job.exitErr, 3)
+	}
+	names := []string{}
+	for _, s := range job.steps {
+		names = append(names, s.Name)
+	}
+	if strings.Join(names, ",") != "drain,fix,undrain" {
+		t.Errorf("got steps %v but expected drain,fix,undrain", names)
+	}
+	if strings.Contains(out.String(), "verifying") {
+		t.Errorf("verify step should be skipped:\n%s", out.String())
+	}
+}
+
+func TestJobRunner_RunGroup(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	s3m := mock.NewMockS3(mockCtrl)
+
+	scripts := map[string]string{
+		"web": "#!/bin/sh\necho restarting web\n",
+		"api": "#!/bin/sh\necho restarting api\nexit 2\n",
+		"db":  "#!/bin/sh\necho restarting db\nexit 1\n",
+	}
+	for key, script := range scripts {
+		body := &stringReadCloser{strings.NewReader(script)}
+		s3m.EXPECT().GetObject(&s3.GetObjectInput{
+			Bucket: aws.String("b"),
+			Key:    aws.String(key),
+		}).Return(&s3.GetObjectOutput{Body: body}, nil)
+	}
+
+	steps := []Step{
+		{Name: "restart", MaxParallelism: 2, Parallel: []Step{
+			{Name: "web", ScriptS3Key: "web"},
+			{Name: "db", ScriptS3Key: "db", OnFailure: "continue"},
+			{Name: "api", ScriptS3Key: "api"},
+		}},
+	}
+	if err := validateSteps(steps); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := &bytes.Buffer{}
+	output := NewOutput(nil)
+	output.AddRawWriter(buf)
+	out := output.Stream(streamAgent)
+	r := &jobRunner{
+		clients:    &awsClients{s3: s3m},
+		output:     output,
+		out:        out,
+		stdout:     output.Stream(streamStdout),
+		stderr:     output.Stream(streamStderr),
+		inheritEnv: "all",
+	}
+	job, err := r.runSteps(steps, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	output.Flush()
+
+	if job.exitStatus != 2 || job.exitErr != nil {
+		t.Errorf("got exit status %d (%v) but expected %d", job.exitStatus, job.exitErr, 2)
+	}
+	if len(job.steps) != 1 || len(job.steps[0].Steps) != 3 {
+		t.Fatalf("unexpected step results: %+v", job.steps)
+	}
+	for _, l := range []string{"[web] restarting web\n", "[db] restarting db\n", "[api] restarting api\n"} {
+		if !strings.Contains(buf.String(), l) {
+			t.Errorf("output should contain %q:\n%s", l, buf.String())
+		}
+	}
+}
+
+func TestJobRunner_RunGroupTerminated(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	s3m := mock.NewMockS3(mockCtrl)
+
+	// Either step runs first; the other one waits for the semaphore and
+	// must not be fetched nor run.
+	body := &stringReadCloser{strings.NewReader("#!/bin/sh\necho restarting\nexec sleep 10\n")}
+	s3m.EXPECT().GetObject(&s3.GetObjectInput{
+		Bucket: aws.String("b"),
+		Key:    aws.String("restart"),
+	}).Return(&s3.GetObjectOutput{Body: body}, nil)
+
+	steps := []Step{
+		{Name: "restart", MaxParallelism: 1, Parallel: []Step{
+			{Name: "web", ScriptS3Key: "restart"},
+			{Name: "api", ScriptS3Key: "restart"},
+		}},
+	}
+	if err := validateSteps(steps); err != nil {
+		t.Fatal(err)
+	}
+
+	signalCh := make(chan *signal, 1)
+	buf := &bytes.Buffer{}
+	output := NewOutput(nil)
+	output.AddRawWriter(buf)
+	r := &jobRunner{
+		clients:    &awsClients{s3: s3m},
+		output:     output,
+		out:        output.Stream(streamAgent),
+		stdout:     output.Stream(streamStdout),
+		stderr:     output.Stream(streamStderr),
+		inheritEnv: "all",
+		signalCh:   signalCh,
+	}
+	go func() {
+		time.Sleep(500 * time.Millisecond)
+		signalCh <- &signal{Action: signalActionSignal, number: syscall.SIGTERM}
+	}()
+	job, err := r.runSteps(steps, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	output.Flush()
+
+	if job.exitStatus == 0 {
+		t.Errorf("the group should fail when it is terminated")
+	}
+	if strings.Count(buf.String(), "skipped: the group is stopped by signal 15]") != 1 {
+		t.Errorf("the pending step should be skipped:\n%s", buf.String())
+	}
+}
+
+func TestSignalBroadcaster_AcksUndelivered(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	s3m := mock.NewMockS3(mockCtrl)
+
+	acks := []signalAck{}
+	s3m.EXPECT().PutObject(gomock.Any()).Do(func(input *s3.PutObjectInput) {
+		b, _ := ioutil.ReadAll(input.Body)
+		ack := signalAck{}
+		if err := json.Unmarshal(b, &ack); err != nil {
+			t.Fatal(err)
+		}
+		acks = append(acks, ack)
+	}).Return(&s3.PutObjectOutput{}, nil).AnyTimes()
+
+	acker := NewSignalAcker(s3m, "acks", "paramedic/", "i-123", "run-1")
+	acker.Start()
+	signalCh := make(chan *signal)
+	b := newSignalBroadcaster(signalCh, acker)
+
+	pause := func(n int) *signal {
+		return &signal{Action: signalActionPause, ID: fmt.Sprintf("pause-%d", n)}
+	}
+	// no step is running
+	signalCh <- pause(0)
+	// the step does not handle signals, and finishes
+	ch, _ := b.subscribe()
+	for i := 1; i <= stepSignalQueueSize+1; i++ {
+		signalCh <- pause(i)
+	}
+	b.stop()
+	b.unsubscribe(ch)
+	acker.Close()
+
+	if len(acks) != stepSignalQueueSize+2 {
+		t.Fatalf("got %d acks but expected %d", len(acks), stepSignalQueueSize+2)
+	}
+	for _, ack := range acks {
+		if ack.Result != ackResultIgnored || ack.Reason == "" {
+			t.Errorf("unexpected ack: %+v", ack)
+		}
+	}
+}
+
+func TestJobRunner_RunStepsAlways(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	s3m := mock.NewMockS3(mockCtrl)
+
+	scripts := map[string]string{
+		"check":    "#!/bin/sh\necho checking\nexit 4\n",
+		"snapshot": "#!/bin/sh\necho snapshotting\n",
+		"undrain":  "#!/bin/sh\necho undraining\nexit 1\n",
+		"cleanup":  "#!/bin/sh\necho cleaning up\n",
+	}
+	for key, script := range scripts {
+		body := &stringReadCloser{strings.NewReader(script)}
+		s3m.EXPECT().GetObject(&s3.GetObjectInput{
+			Bucket: aws.String("b"),
+			Key:    aws.String(key),
+		}).Return(&s3.GetObjectOutput{Body: body}, nil)
+	}
+
+	steps := []Step{
+		{Name: "check", ScriptS3Key: "check", OnFailure: "run undrain"},
+		{Name: "snapshot", ScriptS3Key: "snapshot", Always: true}, // jumped over
+		{Name: "fix", ScriptS3Key: "fix"},
+		{Name: "undrain", ScriptS3Key: "undrain"},
+		{Name: "verify", ScriptS3Key: "verify"},
+		{Name: "cleanup", ScriptS3Key: "cleanup", Always: true}, // after abort
+	}
+	if err := validateSteps(steps); err != nil {
+		t.Fatal(err)
+	}
+
+	out := &bytes.Buffer{}
+	r := &jobRunner{
+		clients:    &awsClients{s3: s3m},
+		out:        out,
+		stdout:     out,
+		stderr:     out,
+		inheritEnv: "all",
+	}
+	job, err := r.runSteps(steps, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if job.exitStatus != 4 || job.exitErr != nil {
+		t.Errorf("got exit status %d (%v) but expected %d", job.exitStatus, job.exitErr, 4)
+	}
+	names := []string{}
+	for _, s := range job.steps {
+		names = append(names, s.Name)
+	}
+	if strings.Join(names, ",") != "check,snapshot,undrain,cleanup" {
+		t.Errorf("got steps %v but expected check,snapshot,undrain,cleanup", names)
+	}
+}
+
+func TestJobRunner_RunStepsDownloadFailure(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	s3m := mock.NewMockS3(mockCtrl)
+
+	noSuchKey := awserr.New(s3.ErrCodeNoSuchKey, "not found", nil)
+	gomock.InOrder(
+		s3m.EXPECT().GetObject(&s3.GetObjectInput{Bucket: aws.String("b"), Key: aws.String("drain")}).
+			Return(&s3.GetObjectOutput{Body: &stringReadCloser{strings.NewReader("#!/bin/sh\necho draining\n")}}, nil),
+		s3m.EXPECT().GetObject(&s3.GetObjectInput{Bucket: aws.String("b"), Key: aws.String("fix")}).
+			Return(nil, noSuchKey),
+		s3m.EXPECT().GetObject(&s3.GetObjectInput{Bucket: aws.String("b"), Key: aws.String("undrain")}).
+			Return(&s3.GetObjectOutput{Body: &stringReadCloser{strings.NewReader("#!/bin/sh\necho undraining\n")}}, nil),
+	)
+
+	steps := []Step{
+		{Name: "drain", ScriptS3Key: "drain"},
+		{Name: "fix", ScriptS3Key: "fix"},
+		{Name: "verify", ScriptS3Key: "verify"},
+		{Name: "undrain", ScriptS3Key: "undrain", Always: true},
+	}
+	if err := validateSteps(steps); err != nil {
+		t.Fatal(err)
+	}
+
+	out := &bytes.Buffer{}
+	r := &jobRunner{
+		clients:    &awsClients{s3: s3m},
+		out:        out,
+		stdout:     out,
+		stderr:     out,
+		inheritEnv: "all",
+	}
+	job, err := r.runSteps(steps, "b")
+	if err != noSuchKey {
+		t.Errorf("got error %v but expected %v", err, noSuchKey)
+	}
+
+	if job.exitStatus != errorExitStatus || job.exitErr != noSuchKey {
+		t.Errorf("got exit status %d (%v) but expected %d", job.exitStatus, job.exitErr, errorExitStatus)
+	}
+	names := []string{}
+	for _, s := range job.steps {
+		names = append(names, s.Name)
+	}
+	if strings.Join(names, ",") != "drain,fix,undrain" {
+		t.Errorf("got steps %v but expected drain,fix,undrain", names)
+	}
+	if job.steps[1].Error == "" {
+		t.Errorf("the failure of fix should be recorded: %+v", job.steps[1])
+	}
+	if !strings.Contains(out.String(), "undraining") {
+		t.Errorf("undrain step should run:\n%s", out.String())
+	}
+}
+
+func TestValidateSteps_AlwaysInGroup(t *testing.T) {
+	steps := []Step{
+		{Name: "group", Parallel: []Step{
+			{Name: "a", ScriptS3Key: "a", Always: true},
+		}},
+	}
+	if err := validateSteps(steps); err == nil {
+		t.Error("expected an error")
+	}
+}
@@ -0,0 +1,78 @@
+package paramedic
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+const defaultSyslogAddress = "unixgram:///dev/log"
+
+// syslogLogger sends RFC 5424 messages with structured data.
+type syslogLogger struct {
+	conn     net.Conn
+	stream   bool // whether the transport needs octet-counting framing (RFC 6587)
+	hostname string
+	fields   localLogFields
+}
+
+// newSyslogLogger connects to address in the form of "network://address",
+// e.g. "unixgram:///dev/log", "udp://127.0.0.1:514" or "tcp://127.0.0.1:514".
+func newSyslogLogger(address string, fields localLogFields) (*syslogLogger, error) {
+	if address == "" {
+		address = defaultSyslogAddress
+	}
+	parts := strings.SplitN(address, "://", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid syslog address: %s", address)
+	}
+	network, addr := parts[0], parts[1]
+
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "-"
+	}
+
+	return &syslogLogger{
+		conn:     conn,
+		stream:   network == "tcp" || network == "unix",
+		hostname: hostname,
+		fields:   fields,
+	}, nil
+}
+
+func (l *syslogLogger) send(e logEntry) error {
+	// facility user (1), severity informational (6)
+	msg := fmt.Sprintf("<14>1 %s %s paramedic-agent %d - [paramedic@32473 runId=\"%s\" instanceId=\"%s\" logStream=\"%s\" stream=\"%s\"] %s",
+		e.timestamp.UTC().Format(time.RFC3339Nano),
+		l.hostname,
+		os.Getpid(),
+		escapeSDParam(l.fields.RunID),
+		escapeSDParam(l.fields.InstanceID),
+		escapeSDParam(l.fields.LogStream),
+		escapeSDParam(e.stream),
+		e.text,
+	)
+	if l.stream {
+		msg = fmt.Sprintf("%d %s", len(msg), msg)
+	}
+
+	l.conn.SetWriteDeadline(time.Now().Add(localLogWriteTimeout))
+	_, err := l.conn.Write([]byte(msg))
+	return err
+}
+
+func (l *syslogLogger) Close() error {
+	return l.conn.Close()
+}
+
+func escapeSDParam(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(s)
+}
@@ -0,0 +1,258 @@
+package paramedic
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const transcriptPartSize = 5 * 1024 * 1024 // 5 MiB is min size of a part except the last one
+
+type S3TranscriptWriter struct {
+	client   S3
+	bucket   string
+	key      string
+	kmsKeyID string
+	compress bool
+
+	buffer   bytes.Buffer
+	gzip     *gzip.Writer
+	mutex    sync.Mutex
+	sending  sync.Mutex // keeps the order of parts without blocking Write on the uploader
+	closed   bool
+	failed   bool
+	uploadID string
+	parts    []*s3.CompletedPart
+
+	partCh     chan []byte
+	doneCh     chan struct{}
+	retrySleep time.Duration
+}
+
+func NewS3TranscriptWriter(client S3, bucket string, key string, kmsKeyID string, compress bool) *S3TranscriptWriter {
+	w := &S3TranscriptWriter{
+		client:   client,
+		bucket:   bucket,
+		key:      key,
+		kmsKeyID: kmsKeyID,
+		compress: compress,
+		mutex:    sync.Mutex{},
+		closed:   false,
+
+		partCh:     make(chan []byte, 16),
+		doneCh:     make(chan struct{}),
+		retrySleep: time.Second,
+	}
+	if compress {
+		w.gzip = gzip.NewWriter(&w.buffer)
+	}
+	return w
+}
+
+func (w *S3TranscriptWriter) Start() {
+	go func() {
+		for part := range w.partCh {
+			if w.isFailed() {
+				continue
+			}
+			if err := w.uploadPart(part); err != nil {
+				log.Printf("[WARN] Uploading a transcript part failed: %s", err)
+				w.abort()
+			}
+		}
+		w.doneCh <- struct{}{}
+	}()
+}
+
+// Write never returns an error so that a broken transcript upload does not
+// interrupt the command or the other outputs.
+func (w *S3TranscriptWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	if w.closed || w.failed {
+		w.mutex.Unlock()
+		return len(p), nil
+	}
+
+	if w.gzip != nil {
+		w.gzip.Write(p)
+	} else {
+		w.buffer.Write(p)
+	}
+
+	if w.buffer.Len() >= transcriptPartSize {
+		part := make([]byte, w.buffer.Len())
+		copy(part, w.buffer.Bytes())
+		w.buffer.Reset()
+
+		// the lock is released while waiting for the uploader so that only
+		// writers filling another part wait for it
+		w.sending.Lock()
+		w.mutex.Unlock()
+		w.partCh <- part
+		w.sending.Unlock()
+		return len(p), nil
+	}
+
+	w.mutex.Unlock()
+	return len(p), nil
+}
+
+// Close uploads the remaining output and completes the multipart upload.
+// If the whole transcript fits in a single part, it is uploaded by PutObject instead.
+func (w *S3TranscriptWriter) Close() error {
+	log.Println("[DEBUG] Closing S3TranscriptWriter")
+	w.mutex.Lock()
+	w.closed = true
+	if w.gzip != nil {
+		w.gzip.Close()
+	}
+	last := w.buffer.Bytes()
+	w.mutex.Unlock()
+
+	w.sending.Lock()
+	close(w.partCh)
+	w.sending.Unlock()
+	<-w.doneCh
+
+	if w.failed {
+		return errors.New("transcript upload was aborted")
+	}
+
+	if w.uploadID == "" {
+		return w.putObject(last)
+	}
+
+	if err := w.uploadPart(last); err != nil {
+		w.abort()
+		return err
+	}
+	return w.complete()
+}
+
+func (w *S3TranscriptWriter) putObject(body []byte) error {
+	log.Printf("[INFO] Uploading a transcript to s3://%s/%s", w.bucket, w.key)
+	input := &s3.PutObjectInput{
+		Bucket: aws.String(w.bucket),
+		Key:    aws.String(w.key),
+		Body:   bytes.NewReader(body),
+	}
+	if w.compress {
+		input.ContentEncoding = aws.String("gzip")
+	}
+	if w.kmsKeyID != "" {
+		input.ServerSideEncryption = aws.String(s3.ServerSideEncryptionAwsKms)
+		input.SSEKMSKeyId = aws.String(w.kmsKeyID)
+	}
+	_, err := w.client.PutObject(input)
+	return err
+}
+
+func (w *S3TranscriptWriter) createUpload() error {
+	log.Printf("[INFO] Starting a multipart upload of a transcript to s3://%s/%s", w.bucket, w.key)
+	input := &s3.CreateMultipartUploadInput{
+		Bucket: aws.String(w.bucket),
+		Key:    aws.String(w.key),
+	}
+	if w.compress {
+		input.ContentEncoding = aws.String("gzip")
+	}
+	if w.kmsKeyID != "" {
+		input.ServerSideEncryption = aws.String(s3.ServerSideEncryptionAwsKms)
+		input.SSEKMSKeyId = aws.String(w.kmsKeyID)
+	}
+	output, err := w.client.CreateMultipartUpload(input)
+	if err != nil {
+		return err
+	}
+
+	w.uploadID = *output.UploadId
+	return nil
+}
+
+func (w *S3TranscriptWriter) uploadPart(body []byte) error {
+	if w.uploadID == "" {
+		if err := w.createUpload(); err != nil {
+			return err
+		}
+	}
+
+	number := int64(len(w.parts) + 1)
+	log.Printf("[DEBUG] Uploading transcript part %d (%d bytes)", number, len(body))
+
+	sleep := w.retrySleep
+	var err error
+	for i := 0; i < 5; i++ {
+		var output *s3.UploadPartOutput
+		output, err = w.client.UploadPart(&s3.UploadPartInput{
+			Bucket:     aws.String(w.bucket),
+			Key:        aws.String(w.key),
+			UploadId:   aws.String(w.uploadID),
+			PartNumber: aws.Int64(number),
+			Body:       bytes.NewReader(body),
+		})
+		if err == nil {
+			w.parts = append(w.parts, &s3.CompletedPart{
+				ETag:       output.ETag,
+				PartNumber: aws.Int64(number),
+			})
+			return nil
+		}
+
+		log.Printf("[WARN] Uploading transcript part %d failed: %s", number, err)
+		log.Printf("[WARN] will retry after %s", sleep.String())
+		time.Sleep(sleep)
+		sleep *= 2
+	}
+	return err
+}
+
+func (w *S3TranscriptWriter) complete() error {
+	input := &s3.CompleteMultipartUploadInput{
+		Bucket:   aws.String(w.bucket),
+		Key:      aws.String(w.key),
+		UploadId: aws.String(w.uploadID),
+		MultipartUpload: &s3.CompletedMultipartUpload{
+			Parts: w.parts,
+		},
+	}
+	_, err := w.client.CompleteMultipartUpload(input)
+	if err != nil {
+		w.abort()
+		return err
+	}
+
+	log.Printf("[INFO] A transcript is uploaded to s3://%s/%s", w.bucket, w.key)
+	return nil
+}
+
+func (w *S3TranscriptWriter) isFailed() bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.failed
+}
+
+func (w *S3TranscriptWriter) abort() {
+	w.mutex.Lock()
+	w.failed = true
+	w.mutex.Unlock()
+
+	if w.uploadID == "" {
+		return
+	}
+
+	log.Printf("[WARN] Aborting the multipart upload of s3://%s/%s", w.bucket, w.key)
+	_, err := w.client.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(w.bucket),
+		Key:      aws.String(w.key),
+		UploadId: aws.String(w.uploadID),
+	})
+	if err != nil {
+		log.Printf("[WARN] Aborting the multipart upload failed: %s", err)
+	}
+}
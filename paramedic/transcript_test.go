@@ -0,0 +1,134 @@
+package paramedic
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/golang/mock/gomock"
+	"github.com/ryotarai/paramedic-agent/mock"
+)
+
+func TestS3TranscriptWriter_SmallOutput(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	s3m := mock.NewMockS3(mockCtrl)
+
+	w := NewS3TranscriptWriter(s3m, "b", "transcript/i-123.log", "", false)
+	w.Start()
+
+	w.Write([]byte("abc\n"))
+	w.Write([]byte("def\n"))
+	s3m.EXPECT().PutObject(gomock.Any()).Do(func(input *s3.PutObjectInput) {
+		b, _ := ioutil.ReadAll(input.Body)
+		if string(b) != "abc\ndef\n" {
+			t.Errorf("got %q but expected %q", string(b), "abc\ndef\n")
+		}
+		if input.ContentEncoding != nil {
+			t.Errorf("content encoding is set")
+		}
+	}).Return(&s3.PutObjectOutput{}, nil)
+
+	if err := w.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestS3TranscriptWriter_Compressed(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	s3m := mock.NewMockS3(mockCtrl)
+
+	w := NewS3TranscriptWriter(s3m, "b", "transcript/i-123.log.gz", "key-1", true)
+	w.Start()
+
+	w.Write([]byte("abc\n"))
+	s3m.EXPECT().PutObject(gomock.Any()).Do(func(input *s3.PutObjectInput) {
+		if aws.StringValue(input.ContentEncoding) != "gzip" {
+			t.Errorf("got content encoding %q but expected gzip", aws.StringValue(input.ContentEncoding))
+		}
+		if aws.StringValue(input.ServerSideEncryption) != s3.ServerSideEncryptionAwsKms || aws.StringValue(input.SSEKMSKeyId) != "key-1" {
+			t.Errorf("got SSE %q (%q) but expected aws:kms (key-1)", aws.StringValue(input.ServerSideEncryption), aws.StringValue(input.SSEKMSKeyId))
+		}
+		r, err := gzip.NewReader(input.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(r)
+		if string(b) != "abc\n" {
+			t.Errorf("got %q but expected %q", string(b), "abc\n")
+		}
+	}).Return(&s3.PutObjectOutput{}, nil)
+
+	if err := w.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestS3TranscriptWriter_Multipart(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	s3m := mock.NewMockS3(mockCtrl)
+
+	w := NewS3TranscriptWriter(s3m, "b", "transcript/i-123.log", "key-1", false)
+
+	s3m.EXPECT().CreateMultipartUpload(gomock.Any()).Do(func(input *s3.CreateMultipartUploadInput) {
+		if aws.StringValue(input.ServerSideEncryption) != s3.ServerSideEncryptionAwsKms || aws.StringValue(input.SSEKMSKeyId) != "key-1" {
+			t.Errorf("got SSE %q (%q) but expected aws:kms (key-1)", aws.StringValue(input.ServerSideEncryption), aws.StringValue(input.SSEKMSKeyId))
+		}
+	}).Return(&s3.CreateMultipartUploadOutput{UploadId: aws.String("u-1")}, nil)
+	sizes := []int{}
+	s3m.EXPECT().UploadPart(gomock.Any()).Times(2).Do(func(input *s3.UploadPartInput) {
+		b, _ := ioutil.ReadAll(input.Body)
+		sizes = append(sizes, len(b))
+		if aws.StringValue(input.UploadId) != "u-1" || aws.Int64Value(input.PartNumber) != int64(len(sizes)) {
+			t.Errorf("got part %d of %s", aws.Int64Value(input.PartNumber), aws.StringValue(input.UploadId))
+		}
+	}).Return(&s3.UploadPartOutput{ETag: aws.String("etag")}, nil)
+	s3m.EXPECT().CompleteMultipartUpload(gomock.Any()).Do(func(input *s3.CompleteMultipartUploadInput) {
+		if len(input.MultipartUpload.Parts) != 2 {
+			t.Errorf("got %d parts but expected 2", len(input.MultipartUpload.Parts))
+		}
+	}).Return(&s3.CompleteMultipartUploadOutput{}, nil)
+
+	w.Start()
+	chunk := bytes.Repeat([]byte("x"), 1024*1024)
+	for i := 0; i < 6; i++ {
+		w.Write(chunk)
+	}
+	if err := w.Close(); err != nil {
+		t.Error(err)
+	}
+	if len(sizes) != 2 || sizes[0] != transcriptPartSize || sizes[1] != 1024*1024 {
+		t.Errorf("got parts of %v bytes", sizes)
+	}
+}
+
+func TestS3TranscriptWriter_AbortOnPartFailure(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	s3m := mock.NewMockS3(mockCtrl)
+
+	w := NewS3TranscriptWriter(s3m, "b", "transcript/i-123.log", "", false)
+	w.retrySleep = time.Millisecond
+
+	s3m.EXPECT().CreateMultipartUpload(gomock.Any()).Return(&s3.CreateMultipartUploadOutput{UploadId: aws.String("u-1")}, nil)
+	s3m.EXPECT().UploadPart(gomock.Any()).Times(5).Return(nil, errors.New("upload failed"))
+	s3m.EXPECT().AbortMultipartUpload(gomock.Any()).Do(func(input *s3.AbortMultipartUploadInput) {
+		if aws.StringValue(input.UploadId) != "u-1" {
+			t.Errorf("got upload %s but expected u-1", aws.StringValue(input.UploadId))
+		}
+	}).Return(&s3.AbortMultipartUploadOutput{}, nil)
+
+	w.Start()
+	w.Write(bytes.Repeat([]byte("x"), transcriptPartSize))
+	w.Write([]byte("dropped\n"))
+	if err := w.Close(); err == nil {
+		t.Error("expected an error")
+	}
+}
@@ -1,19 +1,36 @@
 package paramedic
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
-	"strings"
 	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
 )
 
 type logEntry struct {
 	text      string
 	timestamp time.Time
+	stream    string        // set by Output
+	line      int64         // set by Output, 0 for lines written by the agent
+	elapsed   time.Duration // set by Output
+	step      string        // set by Output for steps in a parallel group
+}
+
+// jsonLogEvent is a message of a log event in JSON format.
+type jsonLogEvent struct {
+	Message    string `json:"message"`
+	Stream     string `json:"stream"`
+	Line       int64  `json:"line,omitempty"`
+	Step       string `json:"step,omitempty"`
+	ElapsedMs  int64  `json:"elapsedMs"`
+	InstanceID string `json:"instanceId"`
+	RunID      string `json:"runId"`
 }
 
 type CloudWatchLogsWriter struct {
@@ -24,9 +41,13 @@ type CloudWatchLogsWriter struct {
 	buffer        []logEntry
 	mutex         sync.Mutex
 	sequenceToken string
-	partialStr    string
+	splitter      lineSplitter
 	closed        bool
 
+	jsonFormat bool
+	instanceID string
+	runID      string
+
 	closeCh chan struct{}
 	doneCh  chan struct{}
 }
@@ -79,21 +100,38 @@ func (w *CloudWatchLogsWriter) Write(p []byte) (int, error) {
 		return 0, errors.New("already closed")
 	}
 
-	text := w.partialStr + string(p)
-	lines := strings.Split(text, "\n")
-	w.partialStr = lines[len(lines)-1]
-	lines = lines[:len(lines)-1]
-	for _, l := range lines {
-		e := logEntry{
-			text:      l,
-			timestamp: time.Now(),
-		}
-		w.buffer = append(w.buffer, e)
-	}
+	w.buffer = append(w.buffer, w.splitter.split(p)...)
 
 	return len(p), nil
 }
 
+// EnableJSONFormat makes each log event a JSON object carrying run metadata instead of a raw line.
+func (w *CloudWatchLogsWriter) EnableJSONFormat(instanceID string, runID string) {
+	w.jsonFormat = true
+	w.instanceID = instanceID
+	w.runID = runID
+}
+
+// derive returns a new writer to another stream with the same client and settings.
+func (w *CloudWatchLogsWriter) derive(group string, stream string) *CloudWatchLogsWriter {
+	d := NewCloudWatchLogsWriter(w.client, group, stream, w.interval)
+	d.jsonFormat = w.jsonFormat
+	d.instanceID = w.instanceID
+	d.runID = w.runID
+	return d
+}
+
+func (w *CloudWatchLogsWriter) writeEntries(entries []logEntry) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.closed {
+		return
+	}
+
+	w.buffer = append(w.buffer, entries...)
+}
+
 func (w *CloudWatchLogsWriter) Close() error {
 	log.Println("[DEBUG] Closing CloudWatchLogsWriter")
 	w.closed = true
@@ -109,6 +147,11 @@ func (w *CloudWatchLogsWriter) createStream() error {
 		LogStreamName: aws.String(w.stream),
 	}
 	_, err := w.client.CreateLogStream(input)
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == cloudwatchlogs.ErrCodeResourceAlreadyExistsException {
+		// e.g. the agent is run again on the same instance
+		log.Printf("[INFO] Log stream %s already exists", w.stream)
+		return w.refreshSequenceToken()
+	}
 	if err != nil {
 		return err
 	}
@@ -116,19 +159,30 @@ func (w *CloudWatchLogsWriter) createStream() error {
 	return nil
 }
 
+// refreshSequenceToken fetches the sequence token of an existing stream.
+func (w *CloudWatchLogsWriter) refreshSequenceToken() error {
+	output, err := w.client.DescribeLogStreams(&cloudwatchlogs.DescribeLogStreamsInput{
+		LogGroupName:        aws.String(w.group),
+		LogStreamNamePrefix: aws.String(w.stream),
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, s := range output.LogStreams {
+		if aws.StringValue(s.LogStreamName) == w.stream {
+			w.sequenceToken = aws.StringValue(s.UploadSequenceToken)
+			return nil
+		}
+	}
+	return fmt.Errorf("log stream %s is not found", w.stream)
+}
+
 func (w *CloudWatchLogsWriter) flushPartialStr() {
 	w.mutex.Lock()
 	defer w.mutex.Unlock()
 
-	if len(w.partialStr) == 0 {
-		return
-	}
-
-	e := logEntry{
-		text:      w.partialStr,
-		timestamp: time.Now(),
-	}
-	w.buffer = append(w.buffer, e)
+	w.buffer = append(w.buffer, w.splitter.flush()...)
 }
 
 func (w *CloudWatchLogsWriter) flushBuffer() {
@@ -146,8 +200,8 @@ func (w *CloudWatchLogsWriter) flushBufferOnce() int {
 	batch := []logEntry{}
 	batchSize := 0
 	for _, e := range w.buffer {
-		s := len(e.text) + 26      // 26 is size of header of log event
-		if batchSize+s > 1048576 { // 1048576 is max size of a single batch
+		s := len(w.message(e)) + 26 // 26 is size of header of log event
+		if batchSize+s > 1048576 {  // 1048576 is max size of a single batch
 			break
 		}
 		if len(batch) >= 10000 { // 10000 is max count of records in a single batch
@@ -186,7 +240,7 @@ func (w *CloudWatchLogsWriter) putEvents(entries []logEntry) error {
 	events := []*cloudwatchlogs.InputLogEvent{}
 	for _, e := range entries {
 		event := &cloudwatchlogs.InputLogEvent{
-			Message:   aws.String(e.text),
+			Message:   aws.String(w.message(e)),
 			Timestamp: aws.Int64(e.timestamp.UnixNano() / 1000 / 1000),
 		}
 		events = append(events, event)
@@ -202,6 +256,19 @@ func (w *CloudWatchLogsWriter) putEvents(entries []logEntry) error {
 	}
 
 	output, err := w.client.PutLogEvents(input)
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case cloudwatchlogs.ErrCodeInvalidSequenceTokenException:
+			// retried with the latest token
+			if err := w.refreshSequenceToken(); err != nil {
+				log.Printf("[WARN] Failed to refresh the sequence token: %s", err)
+			}
+			return err
+		case cloudwatchlogs.ErrCodeDataAlreadyAcceptedException:
+			log.Printf("[INFO] The log events are already accepted")
+			return w.refreshSequenceToken()
+		}
+	}
 	if err != nil {
 		return err
 	}
@@ -209,3 +276,23 @@ func (w *CloudWatchLogsWriter) putEvents(entries []logEntry) error {
 	w.sequenceToken = *output.NextSequenceToken
 	return nil
 }
+
+func (w *CloudWatchLogsWriter) message(e logEntry) string {
+	if !w.jsonFormat {
+		return e.text
+	}
+
+	b, err := json.Marshal(jsonLogEvent{
+		Message:    e.text,
+		Stream:     e.stream,
+		Line:       e.line,
+		Step:       e.step,
+		ElapsedMs:  int64(e.elapsed / time.Millisecond),
+		InstanceID: w.instanceID,
+		RunID:      w.runID,
+	})
+	if err != nil {
+		return e.text
+	}
+	return string(b)
+}
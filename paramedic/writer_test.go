@@ -1,10 +1,12 @@
 package paramedic
 
 import (
+	"encoding/json"
 	"testing"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
 	"github.com/golang/mock/gomock"
 	"github.com/ryotarai/paramedic-agent/mock"
@@ -48,3 +50,71 @@ func TestCloudWatchLogsWriter_Start(t *testing.T) {
 	}).Return(output, nil)
 	w.flushPartialStr()
 }
+
+func TestCloudWatchLogsWriter_JSONFormat(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	cwlogs := mock.NewMockCloudWatchLogs(mockCtrl)
+	w := NewCloudWatchLogsWriter(cwlogs, "g", "s", time.Hour)
+	w.EnableJSONFormat("i-123", "run-1")
+
+	o := NewOutput(nil)
+	o.AddEntryWriter(w)
+	o.Stream(streamStdout).Write([]byte("abc\n"))
+	o.Stream(streamStderr).Write([]byte("def\n"))
+
+	output := &cloudwatchlogs.PutLogEventsOutput{
+		NextSequenceToken: aws.String("dummy"),
+	}
+	cwlogs.EXPECT().PutLogEvents(gomock.Any()).Do(func(input *cloudwatchlogs.PutLogEventsInput) {
+		got := []jsonLogEvent{}
+		for _, e := range input.LogEvents {
+			ev := jsonLogEvent{}
+			if err := json.Unmarshal([]byte(*e.Message), &ev); err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, ev)
+		}
+		if len(got) != 2 {
+			t.Fatalf("got %d events but expected %d", len(got), 2)
+		}
+		if got[1].Message != "def" || got[1].Stream != streamStderr || got[1].Line != 2 {
+			t.Errorf("unexpected event: %+v", got[1])
+		}
+		if got[0].InstanceID != "i-123" || got[0].RunID != "run-1" {
+			t.Errorf("unexpected metadata: %+v", got[0])
+		}
+	}).Return(output, nil)
+	w.flushBuffer()
+
+	// lines written by the agent are not counted
+	o.Stream(streamAgent).Write([]byte("[exit status: 0]\n"))
+	if o.Bytes() != 8 || o.Lines() != 2 {
+		t.Errorf("got %d bytes and %d lines but expected 8 bytes and 2 lines", o.Bytes(), o.Lines())
+	}
+}
+
+func TestCloudWatchLogsWriter_InvalidSequenceToken(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	cwlogs := mock.NewMockCloudWatchLogs(mockCtrl)
+	w := NewCloudWatchLogsWriter(cwlogs, "g", "s", time.Hour)
+	w.sequenceToken = "stale"
+
+	w.Write([]byte("abc\n"))
+	gomock.InOrder(
+		cwlogs.EXPECT().PutLogEvents(gomock.Any()).Return(nil, awserr.New(cloudwatchlogs.ErrCodeInvalidSequenceTokenException, "invalid", nil)),
+		cwlogs.EXPECT().DescribeLogStreams(gomock.Any()).Return(&cloudwatchlogs.DescribeLogStreamsOutput{
+			LogStreams: []*cloudwatchlogs.LogStream{{LogStreamName: aws.String("s"), UploadSequenceToken: aws.String("fresh")}},
+		}, nil),
+		cwlogs.EXPECT().PutLogEvents(gomock.Any()).Do(func(input *cloudwatchlogs.PutLogEventsInput) {
+			if aws.StringValue(input.SequenceToken) != "fresh" {
+				t.Errorf("got sequence token %s but expected fresh", aws.StringValue(input.SequenceToken))
+			}
+		}).Return(&cloudwatchlogs.PutLogEventsOutput{NextSequenceToken: aws.String("next")}, nil),
+	)
+	w.flushBuffer()
+
+	if w.sequenceToken != "next" {
+		t.Errorf("got sequence token %s but expected next", w.sequenceToken)
+	}
+}